@@ -1,14 +1,13 @@
 package cmd
 
 import (
-	"context"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/wyattis/gbuild/lib"
 )
@@ -17,8 +16,16 @@ import (
 var buildDescription string
 var buildConfig lib.BuildConfig
 
+// One config per module being built
+var buildConfigs []lib.BuildConfig
+
 var (
-	ErrBuildName = errors.New("must define the executable name or have a go.mod file present")
+	ErrBuildName      = errors.New("must define the executable name or have a go.mod file present")
+	ErrDebugSplit     = errors.New("-debug and -split-debug can't be used together since -split-debug ships stripped binaries")
+	ErrBundleTemplate = errors.New("-bundle-template must include {{.BINARY}} when using -separate with multiple binaries")
+	ErrModuleBinaries = errors.New("-bin and -name can't be used when building multiple modules")
+	ErrToolchainTmpl  = errors.New("-bundle-template must include {{.GOVERSION}} when using multiple toolchains")
+	ErrURLTemplate    = errors.New("-url-template is required to generate package manager manifests")
 )
 
 var buildCommand = lib.Cmd{
@@ -35,118 +42,870 @@ var buildCommand = lib.Cmd{
 			return
 		}
 		buildConfig.OutputDir = filepath.Clean(buildConfig.OutputDir)
-		if _, err = lib.ApplyModule(&buildConfig); err != nil {
-			return
-		}
-		if buildConfig.Name == "" {
-			return ErrBuildName
+		// The go command requires GOWORK to be absolute and runs in the module dir
+		if buildConfig.GoWork != "" && buildConfig.GoWork != "off" && buildConfig.GoWork != "auto" {
+			if buildConfig.GoWork, err = filepath.Abs(buildConfig.GoWork); err != nil {
+				return
+			}
 		}
 		buildConfig.Aliases = set.Args()
-		buildConfig.DistributionSet, err = lib.GetBuildTargets(buildConfig)
+		if buildConfigs, err = resolveBuildConfigs(buildConfig); err != nil {
+			return
+		}
+		buildConfig = buildConfigs[0]
 		return
 	},
 	Exec: runBuild,
 }
 
+// Create a config for each of the selected workspace modules or a single
+// config for the current module
+func resolveBuildConfigs(config lib.BuildConfig) (res []lib.BuildConfig, err error) {
+	if config.WorkspaceModule == "" {
+		config, err = configureModule(config)
+		return []lib.BuildConfig{config}, err
+	}
+	// Modules are still selected from the workspace when it's disabled for the
+	// builds
+	gowork := config.GoWork
+	if gowork == "off" {
+		gowork = ""
+	}
+	loc, err := lib.FindWorkFile(gowork)
+	if err != nil {
+		return
+	}
+	ws, err := lib.ParseWork(loc)
+	if err != nil {
+		return
+	}
+	mods, err := ws.Select(config.WorkspaceModule)
+	if err != nil {
+		return
+	}
+	if len(mods) > 1 && (len(config.Binaries) > 0 || config.Name != "") {
+		return nil, ErrModuleBinaries
+	}
+	for _, mod := range mods {
+		modConfig := config
+		modConfig.Dir = mod.Dir
+		if modConfig, err = configureModule(modConfig); err != nil {
+			return
+		}
+		res = append(res, modConfig)
+	}
+	return
+}
+
+// Apply the module settings, binaries and targets to the config
+func configureModule(config lib.BuildConfig) (res lib.BuildConfig, err error) {
+	nameSet := config.Name != ""
+	mod, err := lib.ApplyModule(&config)
+	if err != nil {
+		return
+	}
+	if config.Name == "" {
+		return config, ErrBuildName
+	}
+	if len(config.Binaries) == 0 {
+		if config.Binaries, err = defaultBinaries(config, mod, nameSet); err != nil {
+			return
+		}
+	}
+	for i := range config.Binaries {
+		if config.Binaries[i].Name == "" {
+			config.Binaries[i].Name = config.Name
+		}
+	}
+	if err = config.Binaries.Validate(); err != nil {
+		return
+	}
+	if err = config.Packaging.Validate(); err != nil {
+		return
+	}
+	if config.Debug && config.SplitDebug {
+		return config, ErrDebugSplit
+	}
+	if err = config.Image.Validate(); err != nil {
+		return
+	}
+	if err = config.Resources.Validate(); err != nil {
+		return
+	}
+	if config.Publish.Enabled() && config.Publish.URLTemplate == "" {
+		return config, ErrURLTemplate
+	}
+	if config.Publish.WingetDir != "" {
+		if err = lib.ValidateWingetID(config.Publish.WingetID); err != nil {
+			return
+		}
+	}
+	if config.SeparateBundles && len(config.Binaries) > 1 && !strings.Contains(config.BundleTemplate, ".BINARY") {
+		return config, ErrBundleTemplate
+	}
+	if len(config.Toolchains) > 1 && !strings.Contains(config.BundleTemplate, ".GOVERSION") {
+		return config, ErrToolchainTmpl
+	}
+	if config.Toolchains, err = lib.ResolveToolchains(config); err != nil {
+		return
+	}
+	for _, tc := range config.Toolchains {
+		if err = lib.CheckToolchain(mod, tc); err != nil {
+			if config.StrictToolchain {
+				return
+			}
+			fmt.Printf("warning: %s\n", err)
+			err = nil
+		}
+	}
+	if config.Version == "" {
+		config.Version = lib.GitVersion(config.Dir)
+	}
+	if config.Wasm.TinyGo {
+		if config.Wasm.TinyGoVersion, err = lib.TinyGoVersion(config); err != nil {
+			return
+		}
+	}
+	if config.Reproducible {
+		if config.SourceDate, err = lib.SourceDateEpoch(config.Module.Dir); err != nil {
+			return
+		}
+	}
+	// Record the version of the compiler instead of the go directive
+	config.GoVersion = strings.TrimPrefix(config.Toolchains[0].Version, "go")
+	config.DistributionSet, config.Skipped, err = lib.GetBuildTargets(config)
+	return config, err
+}
+
+// Discover the main package to build when no binaries are specified
+func defaultBinaries(config lib.BuildConfig, mod lib.GoModule, nameSet bool) (res lib.Binaries, err error) {
+	if mod.Path == "" {
+		// Without a module there is nothing to discover
+		return lib.Binaries{{Name: config.Name}}, nil
+	}
+	pkgs, err := lib.FindMainPackages(config)
+	if err != nil {
+		return
+	}
+	pkg, err := lib.DefaultMainPackage(mod.Path, pkgs)
+	if err != nil {
+		return
+	}
+	bin := pkg.Binary()
+	if nameSet || pkg.ImportPath == mod.Path {
+		bin.Name = config.Name
+	}
+	return lib.Binaries{bin}, nil
+}
+
 func initBuild(set *flag.FlagSet) error {
 	set.BoolVar(&buildConfig.Verbose, "v", false, "verbose output")
 	set.StringVar(&buildConfig.OutputDir, "o", "release", "output directory")
 	set.StringVar(&buildConfig.Name, "name", "", "executable name")
-	set.StringVar(&buildConfig.NameTemplate, "name-template", "{{.NAME}}{{.EXT}}", "template to use for each file")
+	set.StringVar(&buildConfig.NameTemplate, "name-template", "{{.BINARY}}{{.EXT}}", "template to use for each file")
 	set.StringVar(&buildConfig.BundleTemplate, "bundle-template", "{{.NAME}}_{{.GOOS}}_{{.GOARCH}}{{.ZIP}}", "template to use for each bundle")
 	set.BoolVar(&buildConfig.Clean, "clean", false, "clean the output directory before building")
 	set.BoolVar(&buildConfig.Generate, "generate", false, "run go generate before building")
+	set.Var(&buildConfig.Generation.Packages, "generate-pkgs", "comma separated package patterns to run go generate on (default ./...)")
+	set.StringVar(&buildConfig.Generation.Run, "generate-run", "", "only run generate directives matching this regular expression")
+	set.StringVar(&buildConfig.Generation.Skip, "generate-skip", "", "skip generate directives matching this regular expression")
+	set.Var(&buildConfig.Generation.Env, "generate-env", "KEY=VALUE environment variable to pass to go generate. May be repeated")
+	set.BoolVar(&buildConfig.Generation.PerTarget, "generate-per-target", false, "run go generate before each target with its GOOS and GOARCH")
 	set.BoolVar(&buildConfig.Dry, "dry", false, "run without actually doing anything")
 	set.BoolVar(&buildConfig.CGO, "cgo", false, "enabled cgo by setting CGO_ENABLED=1 for each build")
+	set.StringVar(&buildConfig.CgoPreset, "cgo-preset", "", "C toolchain preset for cgo cross compiling. Supported: zig")
+	set.Var(&buildConfig.CgoEnvs, "cgo-env", "C toolchain setting for matching targets in the form of target:KEY=VALUE. Ex: linux/arm64:CC=aarch64-linux-gnu-gcc")
+	set.BoolVar(&buildConfig.Static, "static", false, "build statically linked linux binaries and verify they have no dynamic dependencies")
+	set.BoolVar(&buildConfig.Reproducible, "reproducible", false, "build with -trimpath, -buildvcs=false and an empty build ID and use SOURCE_DATE_EPOCH for bundle timestamps")
+	set.BoolVar(&buildConfig.Universal, "universal", false, "merge the darwin/amd64 and darwin/arm64 binaries into universal binaries bundled as darwin/universal")
+	set.BoolVar(&buildConfig.KeepThin, "keep-thin", false, "keep the darwin/amd64 and darwin/arm64 bundles when building universal binaries")
+	set.BoolVar(&buildConfig.SplitDebug, "split-debug", false, "build with DWARF and ship it in a separate .debug.tar.gz next to each stripped bundle")
+	set.StringVar(&buildConfig.Compression.Command, "compress", "", "compress each binary in place before bundling with this command. Ex: \"upx --best\"")
+	set.Var(&buildConfig.Compression.Targets, "compress-targets", "comma separated target patterns the compressor supports. Defaults to the targets UPX supports when using upx and every target otherwise")
+	set.Var(&buildConfig.Packaging.Formats, "package", "comma separated package formats to build for linux targets. Supported: deb, rpm, apk, archlinux")
+	set.StringVar(&buildConfig.Packaging.Name, "pkg-name", "", "package name. Defaults to the bundle name")
+	set.StringVar(&buildConfig.Packaging.Release, "pkg-release", "1", "package release appended to the version")
+	set.StringVar(&buildConfig.Packaging.Maintainer, "pkg-maintainer", "", "package maintainer. Ex: \"Jane Doe <jane@example.com>\"")
+	set.StringVar(&buildConfig.Packaging.Description, "pkg-description", "", "package description")
+	set.StringVar(&buildConfig.Packaging.Homepage, "pkg-homepage", "", "package homepage")
+	set.StringVar(&buildConfig.Packaging.License, "pkg-license", "", "package license")
+	set.Var(&buildConfig.Packaging.Depends, "pkg-depends", "comma separated package dependencies")
+	set.StringVar(&buildConfig.Packaging.BinDir, "pkg-bindir", "/usr/bin", "directory to install the binaries into")
+	set.Var(&buildConfig.Packaging.Files, "pkg-file", "additional file to package in the form of src:/dest[:mode]. May be repeated")
+	set.StringVar(&buildConfig.Packaging.PreInstall, "pkg-preinstall", "", "script to run before installing the package")
+	set.StringVar(&buildConfig.Packaging.PostInstall, "pkg-postinstall", "", "script to run after installing the package")
+	set.StringVar(&buildConfig.Packaging.PreRemove, "pkg-preremove", "", "script to run before removing the package")
+	set.StringVar(&buildConfig.Packaging.PostRemove, "pkg-postremove", "", "script to run after removing the package")
+	set.StringVar(&buildConfig.Publish.URLTemplate, "url-template", "", "template for the download URL of each bundle with the bundle template values plus {{.ARTIFACT}}. Ex: https://example.com/{{.VERSION}}/{{.ARTIFACT}}")
+	set.StringVar(&buildConfig.Publish.HomebrewTap, "brew-tap", "", "write a Homebrew formula for the darwin and linux bundles to this tap directory")
+	set.StringVar(&buildConfig.Publish.HomebrewTest, "brew-test", "", "Ruby code for the test block of the Homebrew formula. Defaults to running the binary with --version")
+	set.StringVar(&buildConfig.Publish.ScoopBucket, "scoop-bucket", "", "write a Scoop manifest for the windows bundles to this bucket directory")
+	set.StringVar(&buildConfig.Publish.WingetDir, "winget-dir", "", "write winget manifests for the windows bundles to this directory")
+	set.StringVar(&buildConfig.Publish.WingetID, "winget-id", "", "winget package identifier in the form of Publisher.Package")
+	set.StringVar(&buildConfig.Publish.NixDir, "nix-dir", "", "write a Nix derivation and flake.nix for the linux and darwin bundles to this directory")
+	set.BoolVar(&buildConfig.Wasm.Exec, "wasm-exec", false, "include wasm_exec.js from the compiler in js/wasm bundles")
+	set.BoolVar(&buildConfig.Wasm.HTML, "wasm-html", false, "generate an index.html which loads the first binary in js/wasm bundles. Implies -wasm-exec")
+	set.BoolVar(&buildConfig.Wasm.TinyGo, "tinygo", false, "build the wasm targets with TinyGo")
+	set.BoolVar(&buildConfig.Resources.Generate, "winres", false, "embed an application manifest and version info into windows binaries")
+	set.StringVar(&buildConfig.Resources.Icon, "winres-icon", "", "embed this .ico or .png file as the icon of windows binaries. Implies -winres")
+	set.StringVar(&buildConfig.Resources.Manifest, "winres-manifest", "", "embed this application manifest instead of the default one. Implies -winres")
+	set.StringVar(&buildConfig.Resources.Company, "winres-company", "", "company name in the version info of windows binaries")
+	set.StringVar(&buildConfig.Resources.Copyright, "winres-copyright", "", "copyright in the version info of windows binaries")
+	set.StringVar(&buildConfig.Image.Layout, "oci", "", "build a multi-arch OCI image from the linux bundles as a \"dir\" or \"tar\" image layout")
+	set.StringVar(&buildConfig.Image.BinDir, "oci-bindir", "/usr/local/bin", "directory to copy the binaries into in the image")
+	set.BoolVar(&buildConfig.Image.CACerts, "oci-ca-certs", false, "include the CA certificates of the host in the image")
+	set.BoolVar(&buildConfig.Image.Passwd, "oci-passwd", false, "include an /etc/passwd and /etc/group with root and a nonroot user (65532) in the image")
+	set.StringVar(&buildConfig.Image.User, "oci-user", "", "user to run the image as. Ex: nonroot")
+	set.Var(&buildConfig.Image.Files, "oci-file", "additional file to add to the image in the form of src:/dest[:mode]. May be repeated")
+	set.Var(&buildConfig.Image.Labels, "oci-label", "image label in the form of key=value. May be repeated")
+	set.BoolVar(&buildConfig.Force, "force", false, "rebuild every target even if it's unchanged since the last build")
+	set.StringVar(&buildConfig.CacheDir, "cache-dir", lib.DefaultCacheDir(), "directory to cache artifacts in. Empty disables the cache")
+	set.Var(&buildConfig.Hooks, "hook", "command to run at a stage in the form of stage:command. Stages: before-all, before-target, after-build, after-bundle, after-all. May be repeated")
+	set.StringVar(&buildConfig.Version, "version", "", "version of the release. Defaults to git describe --tags")
 	set.StringVar(&buildConfig.LdFlags, "ldflags", "", "pass ldflags to build command")
 	set.BoolVar(&buildConfig.Debug, "debug", false, "include debug symbols in build")
+	set.Var(&buildConfig.Binaries, "bin", "binary to build in the form of package[:name[:build args]]. May be repeated")
+	set.BoolVar(&buildConfig.SeparateBundles, "separate", false, "bundle each binary separately instead of together")
+	set.StringVar(&buildConfig.WorkspaceModule, "module", "", "go.work module to build by path, name or directory. Use \"all\" for every module")
+	set.StringVar(&buildConfig.GoWork, "gowork", "", "set GOWORK for each build. Use \"off\" to disable the workspace")
+	set.Var(&buildConfig.Toolchains, "toolchain", "GOTOOLCHAIN value or path to a go binary to build with. May be repeated")
+	set.BoolVar(&buildConfig.StrictToolchain, "strict-toolchain", false, "fail instead of warning when a toolchain is older than go.mod requires")
 	return nil
 }
 
-func runGenerate(config lib.BuildConfig) (err error) {
-	fmt.Println("running go generate")
-	cmd := exec.Command("go", "generate")
-	cmd.Env = os.Environ()
-	cmd.Dir, err = os.Getwd()
+func runGenerate(config lib.BuildConfig, dist *lib.Distribution) (err error) {
+	cmd := lib.GenerateCommand(config, dist)
 	if config.Verbose {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		fmt.Printf("running %s\n", strings.Join(cmd.Args, " "))
 	}
-	if err != nil {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("go generate failed: %w", err)
+	}
+	return
+}
+
+func runBuild(set *flag.FlagSet) (err error) {
+	// Targets which failed have already been reported
+	_, err = buildAll(buildConfigs)
+	return
+}
+
+// Build each of the module configs. Targets which fail don't stop the build
+// and are returned separately.
+func buildAll(configs []lib.BuildConfig) (failed []error, err error) {
+	if configs[0].Dry {
+		fmt.Println("** dry run **")
+	}
+	if !configs[0].Dry && configs[0].Clean {
+		for _, pattern := range []string{"*.zip", "*" + lib.DebugExt, "*.deb", "*.rpm", "*.apk", "*.pkg.tar.zst", "*.oci.tar"} {
+			if err = lib.CleanDirGlob(configs[0].OutputDir, pattern); err != nil {
+				return
+			}
+		}
+	}
+	runData := lib.TemplateData(configs[0], lib.Distribution{}, lib.Binary{})
+	if runData["ARTIFACT"], err = filepath.Abs(configs[0].OutputDir); err != nil {
 		return
 	}
-	if config.Verbose {
-		return cmd.Run()
-	} else {
-		out, err := cmd.CombinedOutput()
+	if !configs[0].Dry {
+		if err = configs[0].Hooks.Run(lib.HookBeforeAll, configs[0], runData); err != nil {
+			return
+		}
+	}
+	manifest := lib.Manifest{}
+	var derivations []lib.NixDerivation
+	for _, config := range configs {
+		if len(configs) > 1 {
+			fmt.Printf("building module %s\n", config.Module.Path)
+		}
+		artifacts, moduleFailed, err := buildModule(config)
+		failed = append(failed, moduleFailed...)
 		if err != nil {
-			os.Stderr.Write(out)
+			return failed, err
+		}
+		if !config.Dry {
+			if artifacts, err = buildUniversal(config, artifacts); err != nil {
+				return failed, err
+			}
+			moduleDerivations, err := publishModule(config, artifacts)
+			if err != nil {
+				return failed, err
+			}
+			derivations = append(derivations, moduleDerivations...)
+			if err = buildImages(config, artifacts); err != nil {
+				return failed, err
+			}
+		}
+		manifest.Artifacts = append(manifest.Artifacts, artifacts...)
+	}
+	if configs[0].Dry {
+		return
+	}
+	if len(derivations) > 0 {
+		if err = lib.WriteNix(configs[0].Publish.NixDir, derivations); err != nil {
+			return
 		}
+		fmt.Printf("wrote Nix flake to %s\n", configs[0].Publish.NixDir)
 	}
+	if len(manifest.Artifacts) > 0 {
+		if err = lib.WriteManifest(configs[0].OutputDir, manifest); err != nil {
+			return
+		}
+	}
+	err = configs[0].Hooks.Run(lib.HookAfterAll, configs[0], runData)
 	return
 }
 
-func runBuild(set *flag.FlagSet) (err error) {
-	config := buildConfig
-	if config.Dry {
-		fmt.Println("** dry run **")
+// Merge the darwin/amd64 and darwin/arm64 bundles and debug artifacts of each
+// toolchain into darwin/universal ones and drop the thin ones unless they are
+// kept
+func buildUniversal(config lib.BuildConfig, artifacts []lib.Artifact) (res []lib.Artifact, err error) {
+	if !config.Universal {
+		return artifacts, nil
+	}
+	for _, dist := range lib.UniversalDistributions {
+		if !config.DistributionSet.Has(dist) {
+			fmt.Printf("skipping universal binaries: %s is not a target\n", lib.DistributionSet{dist})
+			return artifacts, nil
+		}
+	}
+	merged := map[string]bool{}
+	var universal []lib.Artifact
+	for _, tc := range config.Toolchains {
+		config.Toolchain = tc
+		for _, group := range lib.PublishGroups(config, artifacts) {
+			var thin []lib.Artifact
+			for _, dist := range lib.UniversalDistributions {
+				if a, ok := group.Artifact(dist.GOOS, dist.GOARCH); ok {
+					thin = append(thin, a)
+				}
+			}
+			if len(thin) != len(lib.UniversalDistributions) {
+				fmt.Printf("skipping universal binary for %s: missing darwin bundles\n", group.Name)
+				continue
+			}
+			artifact, err := lib.BuildUniversal(config, group, thin)
+			if err != nil {
+				return artifacts, err
+			}
+			if err = runHook(lib.HookAfterBundle, config, artifact.Distribution(), group.Bundle, filepath.Join(config.OutputDir, artifact.Path)); err != nil {
+				return artifacts, err
+			}
+			fmt.Printf("merged %s into %s\n", group.Name, artifact.Name)
+			for _, a := range thin {
+				merged[a.Path] = true
+			}
+			universal = append(universal, artifact)
+			if !config.SplitDebug {
+				continue
+			}
+			var thinDebug []lib.Artifact
+			for _, a := range thin {
+				if debug, ok := lib.DebugArtifact(artifacts, a); ok {
+					thinDebug = append(thinDebug, debug)
+				}
+			}
+			if len(thinDebug) != len(thin) {
+				fmt.Printf("skipping universal debug binary for %s: missing darwin debug artifacts\n", group.Name)
+				continue
+			}
+			debugArtifact, err := lib.BuildUniversalDebug(config, group, thinDebug)
+			if err != nil {
+				return artifacts, err
+			}
+			for _, a := range thinDebug {
+				merged[a.Path] = true
+			}
+			universal = append(universal, debugArtifact)
+		}
+	}
+	for _, a := range artifacts {
+		if merged[a.Path] && !config.KeepThin {
+			if err = os.Remove(filepath.Join(config.OutputDir, filepath.FromSlash(a.Path))); err != nil {
+				return
+			}
+			continue
+		}
+		res = append(res, a)
+	}
+	return append(res, universal...), nil
+}
+
+// Generate the package manager manifests for the artifacts of a module. The
+// Nix derivations are returned so every module can share a flake.
+func publishModule(config lib.BuildConfig, artifacts []lib.Artifact) (derivations []lib.NixDerivation, err error) {
+	if !config.Publish.Enabled() {
+		return
+	}
+	config.Toolchain = config.Toolchains[0]
+	for _, group := range lib.PublishGroups(config, artifacts) {
+		if config.Publish.HomebrewTap != "" {
+			formula, ok, err := lib.NewFormula(config, group)
+			if err != nil {
+				return derivations, err
+			}
+			if ok {
+				loc, err := lib.WriteFormula(config.Publish.HomebrewTap, group.Name, formula)
+				if err != nil {
+					return derivations, err
+				}
+				fmt.Printf("wrote Homebrew formula %s\n", loc)
+			}
+		}
+		if config.Publish.ScoopBucket != "" {
+			manifest, ok, err := lib.NewScoopManifest(config, group)
+			if err != nil {
+				return derivations, err
+			}
+			if ok {
+				loc, err := lib.WriteScoopManifest(config.Publish.ScoopBucket, group.Name, manifest)
+				if err != nil {
+					return derivations, err
+				}
+				fmt.Printf("wrote Scoop manifest %s\n", loc)
+			}
+		}
+		if config.Publish.WingetDir != "" {
+			manifest, ok, err := lib.NewWingetManifest(config, group)
+			if err != nil {
+				return derivations, err
+			}
+			if ok {
+				loc, err := lib.WriteWingetManifest(config.Publish.WingetDir, manifest)
+				if err != nil {
+					return derivations, err
+				}
+				fmt.Printf("wrote winget manifests to %s\n", loc)
+			}
+		}
+		if config.Publish.NixDir != "" {
+			derivation, ok, err := lib.NewNixDerivation(config, group)
+			if err != nil {
+				return derivations, err
+			}
+			if ok {
+				derivations = append(derivations, derivation)
+			}
+		}
+	}
+	return
+}
+
+// Build the OCI images for the linux bundles of a module
+func buildImages(config lib.BuildConfig, artifacts []lib.Artifact) (err error) {
+	if config.Image.Layout == "" {
+		return
+	}
+	config.Toolchain = config.Toolchains[0]
+	for _, group := range lib.PublishGroups(config, artifacts) {
+		loc, ok, err := lib.BuildImage(config, group)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fmt.Printf("wrote OCI image %s\n", loc)
+		}
+	}
+	return
+}
+
+func buildModule(config lib.BuildConfig) (artifacts []lib.Artifact, failed []error, err error) {
+	for _, skipped := range config.Skipped {
+		fmt.Printf("skipping %s\n", skipped)
 	}
 	fmt.Printf("preparing to build %d packages\n", len(config.DistributionSet))
 
-	if !config.Dry && config.Clean {
-		if err = lib.CleanDirGlob(config.OutputDir, "*.zip"); err != nil {
+	if config.Generate && !config.Generation.PerTarget {
+		if err = runGenerate(config, nil); err != nil {
 			return
 		}
 	}
 
-	if config.Generate {
-		if err = runGenerate(config); err != nil {
-			return
+	for _, tc := range config.Toolchains {
+		config.Toolchain = tc
+		fmt.Printf("using toolchain %s\n", tc.Version)
+		for _, dist := range config.DistributionSet {
+			fmt.Printf("building %s\\%s\n", dist.GOOS, dist.GOARCH)
+			if config.Verbose {
+				fmt.Printf("%+v\n", dist)
+			}
+			if config.Dry {
+				continue
+			}
+			if config.Generate && config.Generation.PerTarget {
+				if err := runGenerate(config, &dist); err != nil {
+					fmt.Println(err)
+					failed = append(failed, fmt.Errorf("%s/%s: %w", dist.GOOS, dist.GOARCH, err))
+					continue
+				}
+			}
+			distArtifacts, err := buildCached(config, dist)
+			if err != nil {
+				fmt.Println(err)
+				failed = append(failed, fmt.Errorf("%s/%s: %w", dist.GOOS, dist.GOARCH, err))
+			}
+			artifacts = append(artifacts, distArtifacts...)
 		}
 	}
+	return
+}
 
-	args := []string{"build"}
-	for _, dist := range config.DistributionSet {
-		outPath := filepath.Join(config.OutputDir, config.Name)
-		cmdArgs := append(args, "-o", outPath)
-		ldFlags := config.LdFlags
-		if !config.Debug {
-			ldFlags += " -s"
+// Reuse the artifacts of a distribution when its sources and settings haven't
+// changed since it was last built
+func buildCached(config lib.BuildConfig, dist lib.Distribution) (artifacts []lib.Artifact, err error) {
+	if config.Force || config.CacheDir == "" {
+		return buildDistribution(config, dist)
+	}
+	cache := lib.Cache{Dir: config.CacheDir}
+	key, err := lib.CacheKey(config, dist)
+	if err != nil {
+		return
+	}
+	artifacts, ok, err := cache.Load(key, config)
+	if err != nil {
+		return
+	}
+	if ok {
+		fmt.Printf("using cached %s\\%s\n", dist.GOOS, dist.GOARCH)
+		return
+	}
+	if artifacts, err = buildDistribution(config, dist); err != nil {
+		return
+	}
+	err = cache.Store(key, config, artifacts)
+	return
+}
+
+// Build every binary for a single distribution and bundle them
+func buildDistribution(config lib.BuildConfig, dist lib.Distribution) (artifacts []lib.Artifact, err error) {
+	outPaths := make([]string, 0, len(config.Binaries))
+	defer func() {
+		for _, p := range outPaths {
+			os.Remove(p)
 		}
-		if ldFlags != "" {
-			cmdArgs = append(cmdArgs, "-ldflags", ldFlags)
+	}()
+	if lib.UsesTinyGo(config, dist) {
+		for _, flag := range lib.TinyGoUnsupported(config) {
+			fmt.Printf("ignoring %s for %s/%s: not supported by tinygo\n", flag, dist.GOOS, dist.GOARCH)
 		}
-		cmdArgs = append(cmdArgs, config.BuildArgs...)
-		cmd := exec.CommandContext(context.Background(), "go", cmdArgs...)
-		cmd.Env = append(os.Environ(), []string{
-			fmt.Sprintf("GOOS=%s", dist.GOOS),
-			fmt.Sprintf("GOARCH=%s", dist.GOARCH),
-		}...)
-		if config.CGO {
-			cmd.Env = append(cmd.Env, "CGO_ENABLED=1")
+		// TinyGo binaries don't have a build ID to share with a debug build
+		config.SplitDebug = false
+		config.CGO = false
+	}
+	if config.CGO {
+		env, err := lib.CgoEnviron(config, dist)
+		if err != nil {
+			return nil, err
 		}
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		fmt.Printf("building %s\\%s\n", dist.GOOS, dist.GOARCH)
-		if config.Verbose {
-			fmt.Printf("%+v\n", dist)
+		if err = lib.CheckCgoTools(dist, env); err != nil {
+			return nil, err
 		}
-		if config.Dry {
+	}
+	outDir, err := filepath.Abs(config.OutputDir)
+	if err != nil {
+		return
+	}
+	var wasmExec string
+	if config.Wasm.HasLoader(dist) {
+		if wasmExec, err = lib.WasmExecPath(config, dist); err != nil {
+			return
+		}
+	}
+	compress := config.Compression.Supports(dist)
+	if compress {
+		if err = config.Compression.Check(); err != nil {
+			return
+		}
+	} else if config.Compression.Command != "" {
+		fmt.Printf("skipping compression of %s/%s: not supported by the compressor\n", dist.GOOS, dist.GOARCH)
+	}
+	if config.Resources.Enabled() && dist.GOOS == "windows" && !config.Resources.Has(dist) {
+		fmt.Printf("skipping windows resources for %s/%s: unsupported architecture\n", dist.GOOS, dist.GOARCH)
+	}
+	sizes := map[string]lib.CompressedSize{}
+	targetData := lib.TemplateData(config, dist, lib.Binary{Name: config.Name})
+	targetData["ARTIFACT"] = outDir
+	if err = config.Hooks.Run(lib.HookBeforeTarget, config, targetData); err != nil {
+		return
+	}
+	buildIDs := map[string]string{}
+	for _, bin := range config.Binaries {
+		outPath := filepath.Join(outDir, bin.Name)
+		outPaths = append(outPaths, outPath)
+		if !config.SplitDebug {
+			if err = buildBinary(config, dist, bin, outPath, ""); err != nil {
+				return
+			}
+			if compress {
+				if sizes[bin.Name], err = compressBinary(config, dist, bin, outPath); err != nil {
+					return
+				}
+			}
+			if err = runHook(lib.HookAfterBuild, config, dist, bin, outPath); err != nil {
+				return
+			}
 			continue
 		}
-		if err = cmd.Run(); err != nil {
-			fmt.Println(err)
-			// return err
+		// Build with full DWARF first and then build the stripped binary
+		// with the same build ID
+		debugPath := outPath + ".debug"
+		outPaths = append(outPaths, debugPath)
+		debugConfig := config
+		debugConfig.Debug = true
+		if err = buildBinary(debugConfig, dist, bin, debugPath, ""); err != nil {
+			return
 		}
-		if err == nil {
-			if err = lib.BundleFile(outPath, dist, config); err != nil {
+		if buildIDs[bin.Name], err = lib.ReadBuildID(config, debugPath); err != nil {
+			return
+		}
+		if err = buildBinary(config, dist, bin, outPath, buildIDs[bin.Name]); err != nil {
+			return
+		}
+		if compress {
+			if sizes[bin.Name], err = compressBinary(config, dist, bin, outPath); err != nil {
 				return
 			}
-			if err = os.Remove(outPath); err != nil {
+		}
+		if err = runHook(lib.HookAfterBuild, config, dist, bin, outPath); err != nil {
+			return
+		}
+	}
+
+	for _, group := range lib.BundleGroups(config) {
+		entries := make([]lib.BundleEntry, 0, len(group))
+		debugEntries := make([]lib.BundleEntry, 0, len(group))
+		for _, bin := range group {
+			name, err := lib.RenderName(config, dist, bin)
+			if err != nil {
+				return artifacts, err
+			}
+			binPath := filepath.Join(outDir, bin.Name)
+			entries = append(entries, lib.BundleEntry{Name: name, Path: binPath})
+			debugEntries = append(debugEntries, lib.BundleEntry{Name: name + ".debug", Path: binPath + ".debug"})
+		}
+		if wasmExec != "" {
+			entries = append(entries, lib.BundleEntry{Name: lib.WasmExecName, Path: wasmExec})
+		}
+		if config.Wasm.HTML && wasmExec != "" {
+			htmlPath := filepath.Join(outDir, "index.html")
+			outPaths = append(outPaths, htmlPath)
+			if err = lib.WriteWasmHTML(htmlPath, lib.BundleBinary(config, group).Name, entries[0].Name); err != nil {
+				return artifacts, err
+			}
+			entries = append(entries, lib.BundleEntry{Name: "index.html", Path: htmlPath})
+		}
+		bundleBin := lib.BundleBinary(config, group)
+		finalPath, err := lib.RenderBundlePath(config, dist, bundleBin)
+		if err != nil {
+			return artifacts, err
+		}
+		if err = lib.BundleFile(finalPath, entries, config); err != nil {
+			return artifacts, err
+		}
+		if err = runHook(lib.HookAfterBundle, config, dist, bundleBin, finalPath); err != nil {
+			return artifacts, err
+		}
+		artifact, err := lib.NewArtifact(finalPath, lib.ArtifactBundle, dist, config, group)
+		if err != nil {
+			return artifacts, err
+		}
+		if compress {
+			artifact.Sizes = map[string]lib.CompressedSize{}
+			for _, bin := range group {
+				artifact.Sizes[bin.Name] = sizes[bin.Name]
+			}
+		}
+		pkgArtifacts, err := buildPackages(config, dist, group, bundleBin, outDir)
+		if err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, pkgArtifacts...)
+		if !config.SplitDebug {
+			artifacts = append(artifacts, artifact)
+			continue
+		}
+		debugPath, err := lib.RenderDebugPath(config, dist, bundleBin)
+		if err != nil {
+			return artifacts, err
+		}
+		if err = lib.BundleTarGz(debugPath, debugEntries, config); err != nil {
+			return artifacts, err
+		}
+		debugArtifact, err := lib.NewArtifact(debugPath, lib.ArtifactDebug, dist, config, group)
+		if err != nil {
+			return artifacts, err
+		}
+		artifact.BuildIDs = map[string]string{}
+		for _, bin := range group {
+			artifact.BuildIDs[bin.Name] = buildIDs[bin.Name]
+		}
+		debugArtifact.BuildIDs = artifact.BuildIDs
+		artifacts = append(artifacts, artifact, debugArtifact)
+	}
+	return
+}
+
+// Build the linux packages for a bundle group
+func buildPackages(config lib.BuildConfig, dist lib.Distribution, group lib.Binaries, bundleBin lib.Binary, binDir string) (artifacts []lib.Artifact, err error) {
+	if !config.Packaging.Has(dist) {
+		return
+	}
+	pkg := lib.NewPackage(config, bundleBin, group, binDir)
+	for _, format := range config.Packaging.Formats {
+		formatPkg := pkg
+		if format == lib.PackageAPK && !lib.IsStatic(config, dist) && !lib.UsesTinyGo(config, dist) {
+			// Alpine uses musl, so the apk gets static binaries of its own
+			staticDir, err := os.MkdirTemp("", "gbuild-static")
+			if err != nil {
+				return artifacts, err
+			}
+			defer os.RemoveAll(staticDir)
+			if err = buildStatic(config, dist, group, staticDir); err != nil {
+				return artifacts, err
+			}
+			formatPkg = lib.NewPackage(config, bundleBin, group, staticDir)
+		}
+		finalPath, ok, err := lib.WritePackage(config, format, formatPkg, dist)
+		if err != nil {
+			return artifacts, err
+		}
+		if !ok {
+			fmt.Printf("skipping %s package for %s/%s: unsupported architecture\n", format, dist.GOOS, dist.GOARCH)
+			continue
+		}
+		artifact, err := lib.NewArtifact(finalPath, format, dist, config, group)
+		if err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return
+}
+
+// Build static binaries of a group into dir. Without cgo they are built with
+// the netgo and osusergo tags and the zig preset targets musl with cgo.
+func buildStatic(config lib.BuildConfig, dist lib.Distribution, group lib.Binaries, dir string) (err error) {
+	config.Static = true
+	for _, bin := range group {
+		outPath := filepath.Join(dir, bin.Name)
+		if err = buildBinary(config, dist, bin, outPath, ""); err != nil {
+			return
+		}
+		if config.Compression.Supports(dist) {
+			if _, err = compressBinary(config, dist, bin, outPath); err != nil {
 				return
 			}
 		}
 	}
+	return
+}
+
+// Compress a binary in place and print its size before and after
+func compressBinary(config lib.BuildConfig, dist lib.Distribution, bin lib.Binary, outPath string) (size lib.CompressedSize, err error) {
+	data := lib.TemplateData(config, dist, bin)
+	data["ARTIFACT"] = outPath
+	if size, err = lib.Compress(config, data, outPath); err != nil {
+		return
+	}
+	fmt.Printf("compressed %s for %s/%s: %s\n", bin.Name, dist.GOOS, dist.GOARCH, size)
+	return
+}
+
+func runHook(stage string, config lib.BuildConfig, dist lib.Distribution, bin lib.Binary, artifact string) (err error) {
+	data := lib.TemplateData(config, dist, bin)
+	if data["ARTIFACT"], err = filepath.Abs(artifact); err != nil {
+		return
+	}
+	return config.Hooks.Run(stage, config, data)
+}
+
+// Build a single binary. A non-empty buildID produces a binary without any
+// symbols or DWARF using that build ID.
+func buildBinary(config lib.BuildConfig, dist lib.Distribution, bin lib.Binary, outPath string, buildID string) error {
+	if lib.UsesTinyGo(config, dist) {
+		args, ignored, err := lib.TinyGoBuildArgs(config, dist, bin, outPath)
+		if err != nil {
+			return err
+		}
+		for _, flag := range ignored {
+			fmt.Printf("ignoring %s for %s: not supported by tinygo\n", flag, bin.Name)
+		}
+		// Unlike go build, tinygo doesn't create the output directory
+		if err = os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return err
+		}
+		cmd := lib.TinyGoCommand(config, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if config.Verbose {
+			fmt.Printf("building %s as %s with tinygo\n", bin.Package, bin.Name)
+		}
+		return cmd.Run()
+	}
+	if config.Resources.Has(dist) {
+		syso, err := lib.WriteSyso(config, dist, bin)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(syso)
+	}
+	static := lib.IsStatic(config, dist)
+	cmdArgs := []string{"build", "-o", outPath}
+	ldFlags := config.LdFlags
+	if !config.Debug {
+		ldFlags += " -s"
+	}
+	if static {
+		ldFlags += " " + lib.StaticLdFlags(config)
+	}
+	if buildID != "" {
+		ldFlags += " -w -buildid=" + buildID
+	} else if config.Reproducible && !config.SplitDebug {
+		// Split debug builds share the build ID computed by the toolchain
+		ldFlags += " " + lib.ReproducibleLdFlags
+	}
+	if ldFlags = strings.TrimSpace(ldFlags); ldFlags != "" {
+		cmdArgs = append(cmdArgs, "-ldflags", ldFlags)
+	}
+	cmdArgs = append(cmdArgs, config.BuildArgs...)
+	cmdArgs = append(cmdArgs, bin.BuildArgs...)
+	if static {
+		cmdArgs = lib.StaticArgs(cmdArgs)
+	}
+	if config.Reproducible {
+		cmdArgs = lib.ReproducibleArgs(cmdArgs)
+	}
+	if bin.Package != "" {
+		cmdArgs = append(cmdArgs, bin.Package)
+	}
+	cmd := lib.GoCommand(config, cmdArgs...)
+	cmd.Env = append(cmd.Env, []string{
+		fmt.Sprintf("GOOS=%s", dist.GOOS),
+		fmt.Sprintf("GOARCH=%s", dist.GOARCH),
+	}...)
+	if config.CGO {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=1")
+		env, err := lib.CgoEnviron(config, dist)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, lib.EnvList(env)...)
+	} else if static {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if config.Verbose {
+		fmt.Printf("building %s as %s\n", bin.Package, bin.Name)
+	}
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if static {
+		return lib.CheckStatic(outPath)
+	}
 	return nil
 }
 
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bufio"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wyattis/gbuild/lib"
+)
+
+//go:embed manual/init.md
+var initDescription string
+
+var initCmd = lib.Cmd{
+	Name:             "init",
+	ShortDescription: "Select the main packages to build",
+	LongDescription:  initDescription,
+	Exec: func(set *flag.FlagSet) (err error) {
+		var config lib.BuildConfig
+		mod, err := lib.ApplyModule(&config)
+		if err != nil {
+			return
+		}
+		if mod.Path == "" {
+			return lib.ErrNoModule
+		}
+		pkgs, err := lib.FindMainPackages(config)
+		if err != nil {
+			return
+		}
+		if len(pkgs) == 0 {
+			return fmt.Errorf("no main packages found")
+		}
+		selected, err := promptPackages(pkgs)
+		if err != nil {
+			return
+		}
+
+		args := []string{"gbuild", "build"}
+		if def, err := lib.DefaultMainPackage(mod.Path, pkgs); err != nil || len(selected) != 1 || selected[0] != def {
+			for _, pkg := range selected {
+				args = append(args, "-bin", pkg.Package)
+			}
+		}
+		args = append(args, set.Args()...)
+		fmt.Printf("\nbuild with:\n  %s\n", strings.Join(args, " "))
+		return
+	},
+}
+
+// Ask which of the packages should be built. An empty answer selects all of
+// them.
+func promptPackages(pkgs lib.MainPackages) (res lib.MainPackages, err error) {
+	fmt.Println("found main packages:")
+	for i, pkg := range pkgs {
+		fmt.Printf("  %d) %s\n", i+1, pkg.Package)
+	}
+	fmt.Print("select packages to build (comma separated, blank for all): ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	err = nil
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return pkgs, nil
+	}
+	for _, val := range strings.Split(line, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || i < 1 || i > len(pkgs) {
+			return nil, fmt.Errorf("invalid selection: %s", val)
+		}
+		res = append(res, pkgs[i-1])
+	}
+	return
+}
+
+func init() {
+	lib.AddCmd(initCmd)
+}
@@ -13,6 +13,7 @@ var listLongDescription string
 
 type ListConfig struct {
 	ShowTargets bool
+	Modules     bool
 }
 
 var listConfig = ListConfig{}
@@ -22,10 +23,14 @@ var listCmd = lib.Cmd{
 	LongDescription:  listLongDescription,
 	Init: func(set *flag.FlagSet) error {
 		set.BoolVar(&listConfig.ShowTargets, "targets", false, "include a list of targets for each alias")
+		set.BoolVar(&listConfig.Modules, "modules", false, "list the modules in the go.work workspace instead of aliases")
 		return nil
 	},
 	Exec: func(set *flag.FlagSet) (err error) {
 		config := listConfig
+		if config.Modules {
+			return listModules()
+		}
 		distributions, err := lib.GetAllDistributions()
 		if err != nil {
 			return
@@ -56,6 +61,21 @@ var listCmd = lib.Cmd{
 	},
 }
 
+func listModules() (err error) {
+	loc, err := lib.FindWorkFile("")
+	if err != nil {
+		return
+	}
+	ws, err := lib.ParseWork(loc)
+	if err != nil {
+		return
+	}
+	for _, mod := range ws.Modules {
+		fmt.Printf("%s\t%s\n", mod.Path, mod.Dir)
+	}
+	return
+}
+
 func init() {
 	lib.AddCmd(listCmd)
 }
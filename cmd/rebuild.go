@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/wyattis/gbuild/lib"
+)
+
+//go:embed manual/rebuild-check.md
+var rebuildDescription string
+
+var (
+	ErrNotReproducible = errors.New("build is not reproducible")
+	ErrTargetsFailed   = errors.New("targets failed to build")
+	ErrNoArtifacts     = errors.New("no artifacts were built")
+)
+
+var rebuildCmd = lib.Cmd{
+	Name:             "rebuild-check",
+	ShortDescription: "Build twice and compare the artifacts",
+	LongDescription:  rebuildDescription,
+	Parse: func(set *flag.FlagSet, args []string) error {
+		return buildCommand.Parse(set, append([]string{"-reproducible"}, args...))
+	},
+	Exec: func(set *flag.FlagSet) (err error) {
+		tmp, err := os.MkdirTemp("", "gbuild-rebuild-")
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(tmp)
+
+		dirs := []string{filepath.Join(tmp, "a"), filepath.Join(tmp, "b")}
+		hashes := make([]map[string]string, len(dirs))
+		for i, dir := range dirs {
+			fmt.Printf("build %d of %d\n", i+1, len(dirs))
+			configs := make([]lib.BuildConfig, len(buildConfigs))
+			for j, config := range buildConfigs {
+				config.OutputDir = dir
+				config.Clean = false
+				config.Dry = false
+				config.Force = true
+				// Only the artifacts are compared so skip everything with side
+				// effects outside of the temporary output directory
+				config.Publish = lib.PublishConfig{}
+				config.Image = lib.ImageConfig{}
+				config.Hooks = nil
+				// Force the packages to be rebuilt instead of using the build cache
+				config.BuildArgs = append([]string{"-a"}, config.BuildArgs...)
+				configs[j] = config
+			}
+			failed, err := buildAll(configs)
+			if err != nil {
+				return err
+			}
+			if len(failed) > 0 {
+				return fmt.Errorf("%w: %w", ErrTargetsFailed, errors.Join(failed...))
+			}
+			if hashes[i], err = artifactHashes(dir); err != nil {
+				return err
+			}
+			if len(hashes[i]) == 0 {
+				return ErrNoArtifacts
+			}
+		}
+		return compareHashes(hashes[0], hashes[1])
+	},
+}
+
+// Hash the binaries and archives listed in the manifest of a build
+func artifactHashes(dir string) (res map[string]string, err error) {
+	res = map[string]string{}
+	m, err := lib.ReadManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	} else if err != nil {
+		return
+	}
+	for _, a := range m.Artifacts {
+		if res[a.Path], err = lib.HashFile(filepath.Join(dir, filepath.FromSlash(a.Path))); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func compareHashes(a, b map[string]string) error {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	mismatched := 0
+	for _, name := range names {
+		switch {
+		case a[name] == "" || b[name] == "":
+			mismatched++
+			fmt.Printf("missing   %s\n", name)
+		case a[name] != b[name]:
+			mismatched++
+			fmt.Printf("differs   %s\n  %s\n  %s\n", name, a[name], b[name])
+		default:
+			fmt.Printf("identical %s %s\n", name, a[name])
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%w: %d of %d artifacts differ", ErrNotReproducible, mismatched, len(names))
+	}
+	return nil
+}
+
+func init() {
+	lib.AddCmd(rebuildCmd)
+}
@@ -1,5 +1,9 @@
 module github.com/wyattis/gbuild
 
-go 1.17
+go 1.22
 
-require github.com/wyattis/z v0.9.21
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/wyattis/z v0.9.21
+	golang.org/x/mod v0.20.0
+)
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var apkArchs = map[string]string{
+	"386":     "x86",
+	"amd64":   "x86_64",
+	"arm":     "armv7",
+	"arm64":   "aarch64",
+	"loong64": "loongarch64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// Map GOARCH to the Alpine architecture name
+func APKArch(goarch string) (arch string, ok bool) {
+	arch, ok = apkArchs[goarch]
+	return
+}
+
+var apkVersionPrefix = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*`)
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// Convert a package version into an Alpine version. Anything after the
+// numeric version like +4+gabcdef becomes a _git suffix.
+func APKVersion(p Package) string {
+	version := apkVersionPrefix.FindString(p.Version)
+	if version == "" {
+		version = "0"
+	}
+	if rest := strings.TrimPrefix(p.Version, version); rest != "" {
+		version += "_git" + digits.FindString(rest)
+	}
+	return version + "-r" + p.Release
+}
+
+// The file name of an Alpine package like name-1.2.3-r1.x86_64.apk
+func APKName(p Package, arch string) string {
+	return fmt.Sprintf("%s-%s.%s.apk", p.Name, APKVersion(p), arch)
+}
+
+// Write an unsigned Alpine package. The package is the gzipped control
+// tarball without its end of archive marker followed by the gzipped data
+// tarball.
+func WriteAPK(finalPath string, p Package, arch string) (err error) {
+	data := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(data)
+	writer := tar.NewWriter(gz)
+	err = writePackageFiles(writer, p, "", func(hdr *tar.Header, content []byte) {
+		sum := sha1.Sum(content)
+		hdr.Format = tar.FormatPAX
+		hdr.PAXRecords = map[string]string{"APK-TOOLS.checksum.SHA1": hex.EncodeToString(sum[:])}
+	})
+	if err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	control, err := apkControl(p, arch, data.Bytes())
+	if err != nil {
+		return
+	}
+	return os.WriteFile(finalPath, append(control, data.Bytes()...), 0644)
+}
+
+func apkControl(p Package, arch string, data []byte) (res []byte, err error) {
+	size, err := p.Size()
+	if err != nil {
+		return
+	}
+	scripts, err := p.Scripts()
+	if err != nil {
+		return
+	}
+	desc, _, _ := StringCut(strings.TrimSpace(p.Config.Description), "\n")
+	if desc == "" {
+		desc = p.Name
+	}
+	dataHash := sha256.Sum256(data)
+	info := strings.Builder{}
+	field := func(key, val string) {
+		if val != "" {
+			fmt.Fprintf(&info, "%s = %s\n", key, val)
+		}
+	}
+	info.WriteString("# Generated by gbuild\n")
+	field("pkgname", p.Name)
+	field("pkgver", APKVersion(p))
+	field("pkgdesc", desc)
+	field("url", p.Config.Homepage)
+	field("builddate", fmt.Sprint(p.ModTime.Unix()))
+	field("packager", p.Config.Maintainer)
+	field("size", fmt.Sprint(size))
+	field("arch", arch)
+	field("origin", p.Name)
+	field("maintainer", p.Config.Maintainer)
+	field("license", p.Config.License)
+	for _, dep := range p.Config.Depends {
+		field("depend", compactDependency(dep))
+	}
+	field("datahash", hex.EncodeToString(dataHash[:]))
+
+	files := []controlFile{{".PKGINFO", info.String(), 0644}}
+	for _, s := range []struct{ name, script string }{
+		{".pre-install", "preinstall"},
+		{".post-install", "postinstall"},
+		{".pre-deinstall", "preremove"},
+		{".post-deinstall", "postremove"},
+	} {
+		if content, ok := scripts[s.script]; ok {
+			files = append(files, controlFile{s.name, content, 0755})
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	writer := tar.NewWriter(gz)
+	for _, f := range files {
+		err = writer.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.content)),
+			ModTime: p.ModTime,
+			Uname:   "root",
+			Gname:   "root",
+		})
+		if err != nil {
+			return
+		}
+		if _, err = writer.Write([]byte(f.content)); err != nil {
+			return
+		}
+	}
+	// The control tarball is concatenated with the data tarball so it must
+	// not end the archive
+	if err = writer.Flush(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
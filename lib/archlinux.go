@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var archLinuxArchs = map[string]string{
+	"386":     "i686",
+	"amd64":   "x86_64",
+	"arm":     "armv7h",
+	"arm64":   "aarch64",
+	"loong64": "loong64",
+	"riscv64": "riscv64",
+}
+
+// Map GOARCH to the Arch Linux architecture name
+func ArchLinuxArch(goarch string) (arch string, ok bool) {
+	arch, ok = archLinuxArchs[goarch]
+	return
+}
+
+// The file name of an Arch Linux package like name-1.2.3-1-x86_64.pkg.tar.zst
+func ArchLinuxName(p Package, arch string) string {
+	return fmt.Sprintf("%s-%s-%s-%s.pkg.tar.zst", p.Name, p.Version, p.Release, arch)
+}
+
+// Write an Arch Linux package. The package is a zstd compressed tarball of
+// the metadata files followed by the package files.
+func WriteArchLinux(finalPath string, p Package, arch string) (err error) {
+	info, err := archLinuxPkgInfo(p, arch)
+	if err != nil {
+		return
+	}
+	install, err := archLinuxInstall(p)
+	if err != nil {
+		return
+	}
+	meta := []controlFile{{".PKGINFO", info, 0644}}
+	if install != "" {
+		meta = append(meta, controlFile{".INSTALL", install, 0644})
+	}
+	mtree, err := archLinuxMtree(p, meta)
+	if err != nil {
+		return
+	}
+	meta = append(meta, controlFile{".MTREE", string(mtree), 0644})
+
+	outf, err := os.Create(finalPath)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	zw, err := zstd.NewWriter(outf, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return
+	}
+	// Closing again after the explicit close below is a no-op
+	defer zw.Close()
+	writer := tar.NewWriter(zw)
+	for _, f := range meta {
+		err = writer.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.content)),
+			ModTime: p.ModTime,
+			Uname:   "root",
+			Gname:   "root",
+		})
+		if err != nil {
+			return
+		}
+		if _, err = writer.Write([]byte(f.content)); err != nil {
+			return
+		}
+	}
+	if err = writePackageFiles(writer, p, "", nil); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = zw.Close(); err != nil {
+		return
+	}
+	return outf.Close()
+}
+
+func archLinuxPkgInfo(p Package, arch string) (res string, err error) {
+	size, err := p.Size()
+	if err != nil {
+		return
+	}
+	desc, _, _ := StringCut(strings.TrimSpace(p.Config.Description), "\n")
+	if desc == "" {
+		desc = p.Name
+	}
+	info := strings.Builder{}
+	field := func(key, val string) {
+		if val != "" {
+			fmt.Fprintf(&info, "%s = %s\n", key, val)
+		}
+	}
+	info.WriteString("# Generated by gbuild\n")
+	field("pkgname", p.Name)
+	field("pkgbase", p.Name)
+	field("pkgver", p.Version+"-"+p.Release)
+	field("pkgdesc", desc)
+	field("url", p.Config.Homepage)
+	field("builddate", fmt.Sprint(p.ModTime.Unix()))
+	field("packager", p.Config.Maintainer)
+	field("size", fmt.Sprint(size))
+	field("arch", arch)
+	field("license", p.Config.License)
+	for _, f := range p.Files {
+		if strings.HasPrefix(f.Dest, "/etc/") {
+			field("backup", strings.TrimPrefix(f.Dest, "/"))
+		}
+	}
+	for _, dep := range p.Config.Depends {
+		field("depend", compactDependency(dep))
+	}
+	return info.String(), nil
+}
+
+// Wrap the maintainer scripts in the functions pacman calls. Upgrades run the
+// install scripts like they do for deb packages.
+func archLinuxInstall(p Package) (res string, err error) {
+	scripts, err := p.Scripts()
+	if err != nil {
+		return
+	}
+	b := strings.Builder{}
+	for _, s := range []struct{ fn, script, upgrade string }{
+		{"pre_install", "preinstall", "pre_upgrade"},
+		{"post_install", "postinstall", "post_upgrade"},
+		{"pre_remove", "preremove", ""},
+		{"post_remove", "postremove", ""},
+	} {
+		content, ok := scripts[s.script]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "%s() {\n%s\n}\n\n", s.fn, strings.TrimSpace(content))
+		if s.upgrade != "" {
+			fmt.Fprintf(&b, "%s() {\n\t%s\n}\n\n", s.upgrade, s.fn)
+		}
+	}
+	return b.String(), nil
+}
+
+// Create the gzipped mtree file which pacman uses to validate the installed
+// files
+func archLinuxMtree(p Package, meta []controlFile) (res []byte, err error) {
+	b := strings.Builder{}
+	b.WriteString("#mtree\n/set type=file uid=0 gid=0 mode=644\n")
+	entry := func(name string, mode int64, content []byte) {
+		md5sum := md5.Sum(content)
+		sha := sha256.Sum256(content)
+		fmt.Fprintf(&b, "./%s time=%d.0 mode=%o size=%d md5digest=%s sha256digest=%s\n",
+			name, p.ModTime.Unix(), mode, len(content), hex.EncodeToString(md5sum[:]), hex.EncodeToString(sha[:]))
+	}
+	for _, f := range meta {
+		entry(f.name, f.mode, []byte(f.content))
+	}
+	for _, dir := range p.Dirs() {
+		fmt.Fprintf(&b, "./%s time=%d.0 mode=755 type=dir\n", strings.TrimPrefix(dir, "/"), p.ModTime.Unix())
+	}
+	for _, f := range p.Files {
+		content, err := os.ReadFile(f.Src)
+		if err != nil {
+			return nil, err
+		}
+		entry(strings.TrimPrefix(f.Dest, "/"), int64(f.Mode), content)
+	}
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	if _, err = gz.Write([]byte(b.String())); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
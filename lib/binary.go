@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type Binary struct {
+	// Name of the executable
+	Name string
+	// Package path passed to go build. Empty means the current directory.
+	Package string
+	// Additional arguments passed to go build for this binary only
+	BuildArgs []string
+}
+
+type Binaries []Binary
+
+// Parse a binary in the form of package[:name[:build args]]. The name defaults
+// to the last element of the package path. It's left empty for packages like
+// "." which are named after the module instead.
+func (b *Binaries) Set(val string) (err error) {
+	pkg, rest, _ := StringCut(val, ":")
+	name, args, _ := StringCut(rest, ":")
+	if pkg == "" {
+		return fmt.Errorf("invalid binary %q: missing package path", val)
+	}
+	if name == "" {
+		if base := path.Base(pkg); base != "." && base != ".." && base != "/" {
+			name = base
+		}
+	}
+	bin := Binary{Name: name, Package: pkg}
+	if strings.TrimSpace(args) != "" {
+		if bin.BuildArgs, err = SplitArgs(args); err != nil {
+			return fmt.Errorf("invalid binary %q: %w", val, err)
+		}
+	}
+	*b = append(*b, bin)
+	return nil
+}
+
+func (b *Binaries) String() string {
+	vals := make([]string, len(*b))
+	for i, bin := range *b {
+		vals[i] = bin.Package + ":" + bin.Name
+	}
+	return strings.Join(vals, ",")
+}
+
+// Check that binary names are unique since they share an output directory
+func (b Binaries) Validate() error {
+	seen := map[string]bool{}
+	for _, bin := range b {
+		if seen[bin.Name] {
+			return fmt.Errorf("duplicate binary name: %s", bin.Name)
+		}
+		seen[bin.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBinariesSet(t *testing.T) {
+	cases := []struct {
+		val     string
+		want    Binary
+		wantErr bool
+	}{
+		{val: ".", want: Binary{Package: "."}},
+		{val: "./cmd/server", want: Binary{Name: "server", Package: "./cmd/server"}},
+		{val: "./cmd/server:srv", want: Binary{Name: "srv", Package: "./cmd/server"}},
+		{val: "..", want: Binary{Package: ".."}},
+		{val: ".:demo", want: Binary{Name: "demo", Package: "."}},
+		{val: "./cmd/cli::-tags netgo", want: Binary{Name: "cli", Package: "./cmd/cli", BuildArgs: []string{"-tags", "netgo"}}},
+		{val: `./cmd/cli:cli:-ldflags "-s -w"`, want: Binary{Name: "cli", Package: "./cmd/cli", BuildArgs: []string{"-ldflags", "-s -w"}}},
+		{val: "./cmd/cli:cli: ", want: Binary{Name: "cli", Package: "./cmd/cli"}},
+		{val: "", wantErr: true},
+		{val: ":name", wantErr: true},
+		{val: `./cmd/cli:cli:-ldflags "-s`, wantErr: true},
+	}
+	for _, c := range cases {
+		var b Binaries
+		err := b.Set(c.val)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) expected an error", c.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) failed: %s", c.val, err)
+			continue
+		}
+		if len(b) != 1 || !reflect.DeepEqual(b[0], c.want) {
+			t.Errorf("Set(%q) = %+v, want %+v", c.val, b, c.want)
+		}
+	}
+}
+
+func TestBinariesValidate(t *testing.T) {
+	if err := (Binaries{{Name: "a"}, {Name: "b"}}).Validate(); err != nil {
+		t.Errorf("unique names failed: %s", err)
+	}
+	if err := (Binaries{{Name: "a"}, {Name: "a", Package: "./cmd/a"}}).Validate(); err == nil {
+		t.Error("duplicate names expected an error")
+	}
+}
@@ -2,63 +2,131 @@ package lib
 
 import (
 	"archive/zip"
-	"bufio"
 	"compress/flate"
-	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type BuildConfig struct {
-	OutputDir      string
-	Name           string
-	GoVersion      string
-	NameTemplate   string
-	BundleTemplate string
-	BuildArgs      []string
-	Clean          bool
-	Dry            bool
-	ShowTargets    bool
-	Verbose        bool
-	CGO            bool
-	LdFlags        string
-	Debug          bool
-	Generate       bool
+	OutputDir       string
+	Name            string
+	GoVersion       string
+	NameTemplate    string
+	BundleTemplate  string
+	BuildArgs       []string
+	Clean           bool
+	Dry             bool
+	ShowTargets     bool
+	Verbose         bool
+	CGO             bool
+	LdFlags         string
+	Debug           bool
+	Generate        bool
+	Generation      GenerateConfig
+	Binaries        Binaries
+	SeparateBundles bool
+	Module          GoModule
+	Dir             string
+	GoWork          string
+	WorkspaceModule string
+	Toolchains      Toolchains
+	Toolchain       Toolchain
+	StrictToolchain bool
+	CgoPreset       string
+	CgoEnvs         CgoEnvs
+	Static          bool
+	Reproducible    bool
+	SplitDebug      bool
+	Universal       bool
+	KeepThin        bool
+	Compression     CompressConfig
+	Packaging       PackageConfig
+	Publish         PublishConfig
+	Image           ImageConfig
+	Wasm            WasmConfig
+	Resources       ResourceConfig
+	Force           bool
+	CacheDir        string
+	Hooks           Hooks
+	Version         string
+	SourceDate      time.Time
 
 	Aliases         StringSlice
 	DistributionSet DistributionSet
+	Skipped         []SkippedTarget
 }
 
-func BundleFile(loc string, dist Distribution, config BuildConfig) (err error) {
-	nameTmpl, err := template.New("name").Parse(config.NameTemplate)
-	if err != nil {
-		return err
-	}
-	bundleTmpl, err := template.New("bundle").Parse(config.BundleTemplate)
-	if err != nil {
-		return err
-	}
+// Data available to the name and bundle templates
+func TemplateData(config BuildConfig, dist Distribution, bin Binary) map[string]string {
 	ext, cext := "", ".zip"
 	if dist.GOOS == "windows" {
 		ext = ".exe"
+	} else if IsWasm(dist) {
+		ext = ".wasm"
+	}
+	return map[string]string{"NAME": config.Name, "BINARY": bin.Name, "GOOS": dist.GOOS, "GOARCH": dist.GOARCH, "EXT": ext, "ZIP": cext, "GOVERSION": config.Toolchain.Version, "VERSION": config.Version}
+}
+
+// Render the name of a binary inside of a bundle
+func RenderName(config BuildConfig, dist Distribution, bin Binary) (string, error) {
+	nameTmpl, err := template.New("name").Parse(config.NameTemplate)
+	if err != nil {
+		return "", err
 	}
-	data := map[string]string{"NAME": config.Name, "GOOS": dist.GOOS, "GOARCH": dist.GOARCH, "EXT": ext, "ZIP": cext}
-	name, err := RenderString(nameTmpl, data)
+	return RenderString(nameTmpl, TemplateData(config, dist, bin))
+}
+
+// Render the path of a bundle. When all binaries are bundled together the
+// BINARY is the same as the NAME.
+func RenderBundlePath(config BuildConfig, dist Distribution, bin Binary) (string, error) {
+	return renderBundlePath(config, TemplateData(config, dist, bin))
+}
+
+func renderBundlePath(config BuildConfig, data map[string]string) (string, error) {
+	bundleTmpl, err := template.New("bundle").Parse(config.BundleTemplate)
 	if err != nil {
-		return err
+		return "", err
 	}
 	bundleName, err := RenderString(bundleTmpl, data)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return filepath.Join(config.OutputDir, bundleName), nil
+}
 
-	finalPath := filepath.Join(config.OutputDir, bundleName)
+// The binaries which go into each bundle for a distribution
+func BundleGroups(config BuildConfig) (groups []Binaries) {
+	if config.SeparateBundles {
+		for _, bin := range config.Binaries {
+			groups = append(groups, Binaries{bin})
+		}
+		return
+	}
+	return []Binaries{config.Binaries}
+}
+
+// The binary used to render the bundle name for a group
+func BundleBinary(config BuildConfig, group Binaries) Binary {
+	if config.SeparateBundles {
+		return group[0]
+	}
+	return Binary{Name: config.Name}
+}
+
+type BundleEntry struct {
+	// Name of the file inside of the bundle
+	Name string
+	// Location of the file on disk
+	Path string
+}
+
+func BundleFile(finalPath string, entries []BundleEntry, config BuildConfig) (err error) {
 	if config.Verbose {
 		fmt.Println("finalPath", finalPath)
 	}
@@ -67,19 +135,36 @@ func BundleFile(loc string, dist Distribution, config BuildConfig) (err error) {
 		return err
 	}
 	defer outf.Close()
-	inF, err := os.Open(loc)
-	if err != nil {
-		return err
-	}
-	defer inF.Close()
 	writer := zip.NewWriter(outf)
 	writer.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
 		return flate.NewWriter(w, flate.BestCompression)
 	})
 	defer writer.Close()
-	outz, err := writer.Create(name)
+	if config.Reproducible {
+		entries = append([]BundleEntry{}, entries...)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	for _, entry := range entries {
+		if err = addZipFile(writer, entry, config.SourceDate); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func addZipFile(writer *zip.Writer, entry BundleEntry, modified time.Time) (err error) {
+	inF, err := os.Open(entry.Path)
 	if err != nil {
-		return err
+		return
+	}
+	defer inF.Close()
+	outz, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return
 	}
 	_, err = io.Copy(outz, inF)
 	return
@@ -90,7 +175,7 @@ func GetAliases(availableDistributions DistributionSet) (aliases map[string]Dist
 	aliases = map[string]DistributionSet{
 		"all":     availableDistributions,
 		"mobile":  availableDistributions.Only("android", "ios"),
-		"web":     availableDistributions.Only("js"),
+		"web":     availableDistributions.Only("js", "wasip1"),
 		"apple":   availableDistributions.Only("darwin", "ios"),
 		"desktop": availableDistributions.Only("windows", "darwin", "linux"),
 		"unix":    availableDistributions.Only("linux", "aix", "dragonfly", "freebsd", "illumos", "netbsd", "openbsd", "plan9", "solaris"),
@@ -116,7 +201,7 @@ func GetAliases(availableDistributions DistributionSet) (aliases map[string]Dist
 	return
 }
 
-func GetBuildTargets(config BuildConfig) (res DistributionSet, err error) {
+func GetBuildTargets(config BuildConfig) (res DistributionSet, skipped []SkippedTarget, err error) {
 	availableDistributions, err := GetAllDistributions()
 	if err != nil {
 		return
@@ -127,109 +212,72 @@ func GetBuildTargets(config BuildConfig) (res DistributionSet, err error) {
 		config.Aliases = append(config.Aliases, "first-class")
 	}
 
+	// Targets named directly (goos/goarch) must be buildable
+	explicit := DistributionSet{}
 	for _, alias := range config.Aliases {
 		isDiff := strings.HasPrefix(alias, "-")
 		if isDiff {
 			alias = alias[1:]
 		}
-		if vals, ok := aliases[alias]; ok {
-			if isDiff {
-				res = res.Difference(vals)
-			} else {
-				res = res.Union(vals)
+		vals, ok := aliases[alias]
+		if !ok {
+			vals, ok = getExplicitTarget(availableDistributions, alias)
+			if ok && !isDiff {
+				explicit = explicit.Union(vals)
 			}
-		} else {
+		}
+		if !ok {
 			err = fmt.Errorf("unknown alias: %s", alias)
 			return
 		}
+		if isDiff {
+			res = res.Difference(vals)
+			explicit = explicit.Difference(vals)
+		} else {
+			res = res.Union(vals)
+		}
 	}
 
-	return enhanceDistributions(res, config)
-
-}
-
-func enhanceDistributions(d DistributionSet, config BuildConfig) (res DistributionSet, err error) {
-	res = d
-	// nameTmpl, err := template.New("name").Parse(config.NameTemplate)
-	// if err != nil {
-	// 	return
-	// }
-	bundleTmpl, err := template.New("bundle").Parse(config.BundleTemplate)
-	if err != nil {
-		return
-	}
-
-	for i := range res {
-		ext, cext := "", ".zip"
-		if res[i].GOOS == "windows" {
-			ext = ".exe"
-		}
-		data := map[string]string{"NAME": config.Name, "GOOS": res[i].GOOS, "GOARCH": res[i].GOARCH, "EXT": ext, "ZIP": cext}
-		bundleName, err := RenderString(bundleTmpl, data)
-		if err != nil {
-			return res, err
+	res, skipped = GetHost(config).Classify(res)
+	for _, s := range skipped {
+		if explicit.Has(s.Distribution) {
+			err = fmt.Errorf("unable to build %s", s)
+			return
 		}
-
-		finalPath := filepath.ToSlash(filepath.Join(config.OutputDir, bundleName))
-		res[i].BuildPath = finalPath
 	}
-	return
-}
 
-type GoModule struct {
-	Name      string
-	GoVersion string
+	res, err = enhanceDistributions(res, config)
+	return
 }
 
-// Parse package name and go version from a go.mod file
-func ParseMod(loc string) (mod GoModule, err error) {
-	f, err := os.Open(loc)
-	if err != nil {
+// Find a single target in the form of goos/goarch
+func getExplicitTarget(available DistributionSet, target string) (res DistributionSet, ok bool) {
+	goos, goarch, found := StringCutAny(target, "/", "\\")
+	if !found {
 		return
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if err = scanner.Err(); err != nil {
-			return
-		}
-		line := scanner.Text()
-		if mod.Name == "" && strings.HasPrefix(line, "module") {
-			_, name, found := StringCut(line, " ")
-			if !found {
-				err = fmt.Errorf("invalid module name in %s", loc)
-				return
-			}
-			mod.Name = path.Base(name)
-		}
-		if mod.GoVersion == "" && strings.HasPrefix(line, "go") {
-			_, version, found := StringCut(line, " ")
-			if !found {
-				err = fmt.Errorf("invalid go version in %s", loc)
-				return
-			}
-			mod.GoVersion = version
-		}
-		if mod.GoVersion != "" && mod.Name != "" {
-			return
+	for _, dist := range available {
+		if dist.GOOS == goos && dist.GOARCH == goarch {
+			return DistributionSet{dist}, true
 		}
 	}
 	return
 }
 
-func ApplyModule(config *BuildConfig) (mod GoModule, err error) {
-	config.GoVersion = runtime.Version()
-	mod, err = ParseMod("go.mod")
-	if err != nil {
-		// It's not strictly necessary that the "go.mod" file should exist
-		if errors.Is(err, os.ErrNotExist) {
-			err = nil
+func enhanceDistributions(d DistributionSet, config BuildConfig) (res DistributionSet, err error) {
+	res = d
+	for i := range res {
+		res[i].BuildPaths = nil
+		for _, tc := range config.Toolchains {
+			config.Toolchain = tc
+			for _, group := range BundleGroups(config) {
+				finalPath, err := RenderBundlePath(config, res[i], BundleBinary(config, group))
+				if err != nil {
+					return res, err
+				}
+				res[i].BuildPaths = append(res[i].BuildPaths, filepath.ToSlash(finalPath))
+			}
 		}
-		return
-	}
-	if config.Name == "" {
-		config.Name = mod.Name
 	}
-	config.GoVersion = mod.GoVersion
 	return
 }
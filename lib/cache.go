@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Environment variables which don't change the output of a build
+var cacheIgnoredEnv = []string{"GOCACHE", "GOMODCACHE", "GOTMPDIR", "GOENV", "GOPROXY", "GONOPROXY", "GOPRIVATE", "GONOSUMDB", "GOSUMDB", "GOTELEMETRY", "GOTELEMETRYDIR"}
+
+// Environment variables which change the output of a build in addition to
+// any GO* and CGO_* variables
+var cacheEnv = []string{"CC", "CXX", "AR", "PKG_CONFIG", "SOURCE_DATE_EPOCH"}
+
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	Module     *struct {
+		Path    string
+		Version string
+		Main    bool
+	}
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	CXXFiles   []string
+	HFiles     []string
+	SFiles     []string
+	SysoFiles  []string
+	EmbedFiles []string
+}
+
+// Files which are compiled into the package
+func (p listedPackage) Files() (res []string) {
+	for _, files := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.HFiles, p.SFiles, p.SysoFiles, p.EmbedFiles} {
+		res = append(res, files...)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Compute the cache key of a distribution from its sources, toolchain,
+// environment and build settings
+func CacheKey(config BuildConfig, dist Distribution) (key string, err error) {
+	h := sha256.New()
+	cgoEnv := map[string]string{}
+	if config.CGO {
+		if cgoEnv, err = CgoEnviron(config, dist); err != nil {
+			return
+		}
+	}
+	settings := map[string]interface{}{
+		"GOOS":           dist.GOOS,
+		"GOARCH":         dist.GOARCH,
+		"Toolchain":      config.Toolchain.Version,
+		"Name":           config.Name,
+		"Binaries":       config.Binaries,
+		"BuildArgs":      config.BuildArgs,
+		"LdFlags":        config.LdFlags,
+		"NameTemplate":   config.NameTemplate,
+		"BundleTemplate": config.BundleTemplate,
+		"Separate":       config.SeparateBundles,
+		"Debug":          config.Debug,
+		"SplitDebug":     config.SplitDebug,
+		"Compression":    config.Compression,
+		"Packaging":      config.Packaging,
+		"CGO":            config.CGO,
+		"CgoEnv":         cgoEnv,
+		"Static":         config.Static,
+		"Reproducible":   config.Reproducible,
+		"SourceDate":     config.SourceDate,
+		"GoWork":         config.GoWork,
+		"Hooks":          config.Hooks,
+		"Generate":       config.Generate,
+		"Generation":     config.Generation,
+		"Wasm":           config.Wasm,
+		"Resources":      config.Resources,
+		"Env":            cacheEnviron(),
+	}
+	// The version changes with every commit, so it's only part of the key
+	// when it ends up in the artifacts
+	if usesVersion(config, dist) {
+		settings["Version"] = config.Version
+	}
+	if err = json.NewEncoder(h).Encode(settings); err != nil {
+		return
+	}
+	// Hash the contents of the files which are embedded into the artifacts
+	var inputs []string
+	if config.Packaging.Has(dist) {
+		inputs = append(inputs, config.Packaging.Inputs()...)
+	}
+	if config.Resources.Has(dist) {
+		for _, loc := range []string{config.Resources.Icon, config.Resources.Manifest} {
+			if loc != "" {
+				inputs = append(inputs, loc)
+			}
+		}
+	}
+	for _, loc := range inputs {
+		if err = hashFileInto(h, loc); err != nil {
+			return
+		}
+	}
+	for _, bin := range config.Binaries {
+		if err = hashSources(h, config, dist, bin); err != nil {
+			return
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hook stages which run while a distribution is built
+var cachedHookStages = []string{HookBeforeTarget, HookAfterBuild, HookAfterBundle}
+
+// Check if the version is embedded into the packages or Windows resources or
+// used by the templates and hooks of a distribution
+func usesVersion(config BuildConfig, dist Distribution) bool {
+	if config.Packaging.Has(dist) || config.Resources.Has(dist) {
+		return true
+	}
+	for _, tmpl := range []string{config.NameTemplate, config.BundleTemplate, config.Compression.Command} {
+		if strings.Contains(tmpl, ".VERSION") {
+			return true
+		}
+	}
+	for _, hook := range config.Hooks {
+		if StringSliceContains(cachedHookStages, hook.Stage) && (strings.Contains(hook.Command, ".VERSION") || strings.Contains(hook.Command, "GBUILD_VERSION")) {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheEnviron() (res []string) {
+	for _, env := range os.Environ() {
+		key, _, _ := StringCut(env, "=")
+		if StringSliceContains(cacheIgnoredEnv, key) {
+			continue
+		}
+		if strings.HasPrefix(key, "GO") || strings.HasPrefix(key, "CGO_") || StringSliceContains(cacheEnv, key) {
+			res = append(res, env)
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+// Hash the files of every package the binary depends on. Standard library
+// packages are covered by the toolchain version and packages from the module
+// cache by their version.
+func hashSources(h io.Writer, config BuildConfig, dist Distribution, bin Binary) (err error) {
+	args := []string{"list", "-deps", "-json"}
+	buildArgs := append(append([]string{}, config.BuildArgs...), bin.BuildArgs...)
+	if IsStatic(config, dist) {
+		buildArgs = StaticArgs(buildArgs)
+	}
+	args = append(args, tagArgs(buildArgs)...)
+	if bin.Package != "" {
+		args = append(args, bin.Package)
+	}
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	cmd := GoCommand(config, args...)
+	cmd.Env = append(cmd.Env, "GOOS="+dist.GOOS, "GOARCH="+dist.GOARCH)
+	if config.CGO {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=1")
+	}
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("failed to list dependencies of %s: %w\n%s", bin.Name, err, errBuf.String())
+	}
+	decoder := json.NewDecoder(buf)
+	for {
+		var pkg listedPackage
+		if err = decoder.Decode(&pkg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+		fmt.Fprintln(h, pkg.ImportPath)
+		if pkg.Standard {
+			continue
+		}
+		if pkg.Module != nil && !pkg.Module.Main && pkg.Module.Version != "" {
+			fmt.Fprintln(h, pkg.Module.Path, pkg.Module.Version)
+			continue
+		}
+		for _, name := range pkg.Files() {
+			if err = hashFileInto(h, filepath.Join(pkg.Dir, name)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func hashFileInto(h io.Writer, loc string) error {
+	f, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintln(h, filepath.Base(loc))
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// Only the -tags flag changes which files go list includes
+func tagArgs(args []string) (res []string) {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == "tags" && i+1 < len(args) {
+			res = append(res, arg, args[i+1])
+		} else if strings.HasPrefix(name, "tags=") {
+			res = append(res, arg)
+		}
+	}
+	return
+}
+
+type Cache struct {
+	Dir string
+}
+
+// The default cache directory in the user's cache
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gbuild")
+}
+
+func (c Cache) entryPath(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".json")
+}
+
+func (c Cache) filePath(key string, a Artifact) string {
+	return filepath.Join(c.Dir, key[:2], key, filepath.FromSlash(a.Path))
+}
+
+// Restore the artifacts for a key into the output directory. Artifacts which
+// already exist in the output directory with the same hash are reused as is.
+func (c Cache) Load(key string, config BuildConfig) (artifacts []Artifact, ok bool, err error) {
+	data, err := os.ReadFile(c.entryPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &artifacts); err != nil {
+		return
+	}
+	for _, a := range artifacts {
+		dest := filepath.Join(config.OutputDir, filepath.FromSlash(a.Path))
+		if hash, err := HashFile(dest); err == nil && hash == a.SHA256 {
+			continue
+		}
+		src := c.filePath(key, a)
+		if hash, err := HashFile(src); err != nil || hash != a.SHA256 {
+			return nil, false, nil
+		}
+		if err = copyFile(src, dest); err != nil {
+			return nil, false, err
+		}
+	}
+	return artifacts, true, nil
+}
+
+// Save the artifacts for a key
+func (c Cache) Store(key string, config BuildConfig, artifacts []Artifact) (err error) {
+	for _, a := range artifacts {
+		src := filepath.Join(config.OutputDir, filepath.FromSlash(a.Path))
+		if err = copyFile(src, c.filePath(key, a)); err != nil {
+			return
+		}
+	}
+	data, err := json.Marshal(artifacts)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(c.entryPath(key)), 0755); err != nil {
+		return
+	}
+	return os.WriteFile(c.entryPath(key), data, 0644)
+}
+
+func copyFile(src, dest string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return
+}
@@ -0,0 +1,30 @@
+package lib
+
+import "testing"
+
+func TestUsesVersion(t *testing.T) {
+	linux := Distribution{GOOS: "linux", GOARCH: "amd64"}
+	windows := Distribution{GOOS: "windows", GOARCH: "amd64"}
+	cases := []struct {
+		name   string
+		config BuildConfig
+		dist   Distribution
+		want   bool
+	}{
+		{"plain", BuildConfig{NameTemplate: "{{.BINARY}}{{.EXT}}", BundleTemplate: "{{.NAME}}_{{.GOOS}}_{{.GOARCH}}{{.ZIP}}"}, linux, false},
+		{"go version", BuildConfig{BundleTemplate: "{{.NAME}}_{{.GOVERSION}}{{.ZIP}}"}, linux, false},
+		{"bundle template", BuildConfig{BundleTemplate: "{{.NAME}}_{{.VERSION}}{{.ZIP}}"}, linux, true},
+		{"compressor", BuildConfig{Compression: CompressConfig{Command: "stamp {{.VERSION}}"}}, linux, true},
+		{"packages", BuildConfig{Packaging: PackageConfig{Formats: StringSlice{PackageDeb}}}, linux, true},
+		{"packages on windows", BuildConfig{Packaging: PackageConfig{Formats: StringSlice{PackageDeb}}}, windows, false},
+		{"resources", BuildConfig{Resources: ResourceConfig{Icon: "app.ico"}}, windows, true},
+		{"build hook", BuildConfig{Hooks: Hooks{{Stage: HookAfterBuild, Command: "sign -v {{.VERSION}} {{.ARTIFACT}}"}}}, linux, true},
+		{"hook env", BuildConfig{Hooks: Hooks{{Stage: HookAfterBundle, Command: `sh -c "echo $GBUILD_VERSION"`}}}, linux, true},
+		{"after all hook", BuildConfig{Hooks: Hooks{{Stage: HookAfterAll, Command: "release {{.VERSION}}"}}}, linux, false},
+	}
+	for _, c := range cases {
+		if got := usesVersion(c.config, c.dist); got != c.want {
+			t.Errorf("%s: usesVersion = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
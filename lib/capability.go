@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+type Capabilities struct {
+	// The target can only be linked by an external (C) linker
+	ExternalLinker bool
+	// The target requires cgo to be enabled
+	Cgo bool
+	// The target can only be linked on a darwin host with Xcode installed
+	DarwinHost bool
+}
+
+// Determine the build requirements of a distribution. This mirrors the rules
+// in the Go toolchain's internal/platform package.
+func (d Distribution) Capabilities() (c Capabilities) {
+	switch d.GOOS {
+	case "android":
+		c.ExternalLinker = d.GOARCH != "arm64"
+	case "ios":
+		c.ExternalLinker = d.GOARCH == "arm64"
+		c.DarwinHost = c.ExternalLinker
+	}
+	c.Cgo = c.ExternalLinker
+	return
+}
+
+type Host struct {
+	GOOS      string
+	GOARCH    string
+	CGO       bool
+	CC        string
+	CgoPreset string
+	CgoEnvs   CgoEnvs
+}
+
+// Describe the host doing the building using the settings in config
+func GetHost(config BuildConfig) Host {
+	return Host{
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		CGO:       config.CGO,
+		CC:        os.Getenv("CC"),
+		CgoPreset: config.CgoPreset,
+		CgoEnvs:   config.CgoEnvs,
+	}
+}
+
+// Check if the distribution can be built on this host. If not, a reason is
+// returned.
+func (h Host) CanBuild(d Distribution) (ok bool, reason string) {
+	c := d.Capabilities()
+	if c.DarwinHost && h.GOOS != "darwin" {
+		return false, "requires a darwin host with Xcode"
+	}
+	if c.Cgo && !h.CGO {
+		return false, "requires cgo (enable with -cgo)"
+	}
+	if c.ExternalLinker {
+		cc := h.CC
+		if env, err := cgoEnviron(h.CgoPreset, h.CgoEnvs, d, false); err != nil {
+			return false, err.Error()
+		} else if env["CC"] != "" {
+			cc = env["CC"]
+		}
+		isNative := d.GOOS == h.GOOS && d.GOARCH == h.GOARCH
+		if !isNative && cc == "" {
+			return false, fmt.Sprintf("requires an external linker for %s/%s (set CC or use -cgo-env)", d.GOOS, d.GOARCH)
+		}
+		if cc := strings.Fields(cc); len(cc) > 0 {
+			if _, err := exec.LookPath(cc[0]); err != nil {
+				return false, fmt.Sprintf("C compiler %s not found", cc[0])
+			}
+		}
+	}
+	return true, ""
+}
+
+type SkippedTarget struct {
+	Distribution Distribution
+	Reason       string
+}
+
+func (s SkippedTarget) String() string {
+	return fmt.Sprintf("%s/%s: %s", s.Distribution.GOOS, s.Distribution.GOARCH, s.Reason)
+}
+
+// Split a set into the distributions which can be built on this host and the
+// ones which can't
+func (h Host) Classify(d DistributionSet) (buildable DistributionSet, skipped []SkippedTarget) {
+	for _, dist := range d {
+		if ok, reason := h.CanBuild(dist); ok {
+			buildable = append(buildable, dist)
+		} else {
+			skipped = append(skipped, SkippedTarget{dist, reason})
+		}
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Environment variables which can be configured per target
+var cgoEnvKeys = []string{"CC", "CXX", "AR", "CGO_CFLAGS", "CGO_CXXFLAGS", "CGO_LDFLAGS", "PKG_CONFIG"}
+
+type CgoEnv struct {
+	// Target pattern like linux/arm64, linux/* or *
+	Pattern string
+	Key     string
+	Value   string
+}
+
+func (e CgoEnv) Matches(dist Distribution) bool {
+	ok, _ := path.Match(e.Pattern, dist.GOOS+"/"+dist.GOARCH)
+	return ok
+}
+
+type CgoEnvs []CgoEnv
+
+// Parse a value in the form of target:KEY=VALUE
+func (c *CgoEnvs) Set(val string) error {
+	pattern, env, found := StringCut(val, ":")
+	if !found {
+		return fmt.Errorf("invalid cgo env %q: expected target:KEY=VALUE", val)
+	}
+	key, value, found := StringCut(env, "=")
+	if !found {
+		return fmt.Errorf("invalid cgo env %q: expected target:KEY=VALUE", val)
+	}
+	if !StringSliceContains(cgoEnvKeys, key) {
+		return fmt.Errorf("invalid cgo env %q: key must be one of %s", val, strings.Join(cgoEnvKeys, ", "))
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid cgo env %q: %w", val, err)
+	}
+	*c = append(*c, CgoEnv{Pattern: pattern, Key: key, Value: value})
+	return nil
+}
+
+func (c *CgoEnvs) String() string {
+	vals := make([]string, len(*c))
+	for i, e := range *c {
+		vals[i] = e.Pattern + ":" + e.Key + "=" + e.Value
+	}
+	return strings.Join(vals, ",")
+}
+
+var zigArchs = map[string]string{
+	"386":      "x86",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "powerpc64",
+	"ppc64le":  "powerpc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// Map a distribution to the target triple used by zig cc. Linux targets use
+// musl instead of glibc when musl is true.
+func ZigTriple(dist Distribution, musl bool) (triple string, ok bool) {
+	arch, ok := zigArchs[dist.GOARCH]
+	if !ok {
+		return
+	}
+	switch dist.GOOS {
+	case "linux":
+		abi := "gnu"
+		switch dist.GOARCH {
+		case "arm":
+			abi = "gnueabihf"
+		case "mips64", "mips64le":
+			abi = "gnuabi64"
+		case "mips", "mipsle":
+			abi = "gnueabi"
+		}
+		if musl {
+			abi = "musl" + strings.TrimPrefix(abi, "gnu")
+		}
+		return arch + "-linux-" + abi, true
+	case "windows":
+		return arch + "-windows-gnu", true
+	case "darwin":
+		return arch + "-macos", true
+	}
+	return "", false
+}
+
+// Environment from the C toolchain preset for a distribution
+func cgoPresetEnv(preset string, dist Distribution, static bool) (env map[string]string, err error) {
+	env = map[string]string{}
+	switch preset {
+	case "", "none":
+	case "zig":
+		triple, ok := ZigTriple(dist, static)
+		if !ok {
+			return env, fmt.Errorf("zig cc doesn't support %s/%s", dist.GOOS, dist.GOARCH)
+		}
+		env["CC"] = "zig cc -target " + triple
+		env["CXX"] = "zig c++ -target " + triple
+		env["AR"] = "zig ar"
+	default:
+		return env, fmt.Errorf("unknown C toolchain preset: %s", preset)
+	}
+	return
+}
+
+// Compute the C toolchain environment for a distribution. Values from the
+// preset are replaced by matching target envs in the order they were given.
+func CgoEnviron(config BuildConfig, dist Distribution) (env map[string]string, err error) {
+	return cgoEnviron(config.CgoPreset, config.CgoEnvs, dist, IsStatic(config, dist))
+}
+
+func cgoEnviron(preset string, envs CgoEnvs, dist Distribution, static bool) (env map[string]string, err error) {
+	env, err = cgoPresetEnv(preset, dist, static)
+	for _, e := range envs {
+		if e.Matches(dist) {
+			env[e.Key] = e.Value
+		}
+	}
+	// A target the preset doesn't support is fine when CC is set explicitly
+	if err != nil && env["CC"] != "" {
+		err = nil
+	}
+	return
+}
+
+// Flatten the environment into KEY=VALUE pairs
+func EnvList(env map[string]string) (res []string) {
+	for key, val := range env {
+		res = append(res, key+"="+val)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Check that the configured C compilers exist before building a distribution
+func CheckCgoTools(dist Distribution, env map[string]string) error {
+	cc := env["CC"]
+	if cc == "" {
+		cc = os.Getenv("CC")
+	}
+	isNative := dist.GOOS == runtime.GOOS && dist.GOARCH == runtime.GOARCH
+	if cc == "" && !isNative {
+		return fmt.Errorf("cross compiling %s/%s with cgo requires CC (see -cgo-env and -cgo-preset)", dist.GOOS, dist.GOARCH)
+	}
+	for _, key := range []string{"CC", "CXX", "AR"} {
+		fields := strings.Fields(env[key])
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			return fmt.Errorf("%s for %s/%s not found: %s", key, dist.GOOS, dist.GOARCH, fields[0])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCgoEnvsSet(t *testing.T) {
+	cases := []struct {
+		val     string
+		want    CgoEnv
+		wantErr bool
+	}{
+		{val: "linux/arm64:CC=aarch64-linux-gnu-gcc", want: CgoEnv{Pattern: "linux/arm64", Key: "CC", Value: "aarch64-linux-gnu-gcc"}},
+		{val: "linux/*:CGO_CFLAGS=-O2 -g", want: CgoEnv{Pattern: "linux/*", Key: "CGO_CFLAGS", Value: "-O2 -g"}},
+		{val: "*:CGO_LDFLAGS=-L/opt/lib=x", want: CgoEnv{Pattern: "*", Key: "CGO_LDFLAGS", Value: "-L/opt/lib=x"}},
+		{val: "windows/amd64:CC=", want: CgoEnv{Pattern: "windows/amd64", Key: "CC"}},
+		{val: "CC=gcc", wantErr: true},
+		{val: "linux/amd64:CC", wantErr: true},
+		{val: "linux/amd64:GOOS=linux", wantErr: true},
+		{val: "linux/[:CC=gcc", wantErr: true},
+	}
+	for _, c := range cases {
+		var envs CgoEnvs
+		err := envs.Set(c.val)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) expected an error", c.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) failed: %s", c.val, err)
+			continue
+		}
+		if len(envs) != 1 || envs[0] != c.want {
+			t.Errorf("Set(%q) = %+v, want %+v", c.val, envs, c.want)
+		}
+	}
+}
+
+func TestZigTriple(t *testing.T) {
+	cases := []struct {
+		dist   Distribution
+		musl   bool
+		triple string
+		ok     bool
+	}{
+		{Distribution{GOOS: "linux", GOARCH: "amd64"}, false, "x86_64-linux-gnu", true},
+		{Distribution{GOOS: "linux", GOARCH: "amd64"}, true, "x86_64-linux-musl", true},
+		{Distribution{GOOS: "linux", GOARCH: "arm"}, false, "arm-linux-gnueabihf", true},
+		{Distribution{GOOS: "linux", GOARCH: "arm"}, true, "arm-linux-musleabihf", true},
+		{Distribution{GOOS: "linux", GOARCH: "mips64le"}, false, "mips64el-linux-gnuabi64", true},
+		{Distribution{GOOS: "linux", GOARCH: "mips"}, true, "mips-linux-musleabi", true},
+		{Distribution{GOOS: "linux", GOARCH: "386"}, false, "x86-linux-gnu", true},
+		{Distribution{GOOS: "windows", GOARCH: "arm64"}, true, "aarch64-windows-gnu", true},
+		{Distribution{GOOS: "darwin", GOARCH: "arm64"}, false, "aarch64-macos", true},
+		{Distribution{GOOS: "freebsd", GOARCH: "amd64"}, false, "", false},
+		{Distribution{GOOS: "js", GOARCH: "wasm"}, false, "", false},
+	}
+	for _, c := range cases {
+		triple, ok := ZigTriple(c.dist, c.musl)
+		if triple != c.triple || ok != c.ok {
+			t.Errorf("ZigTriple(%s/%s, %t) = %q, %t, want %q, %t", c.dist.GOOS, c.dist.GOARCH, c.musl, triple, ok, c.triple, c.ok)
+		}
+	}
+}
+
+func TestCgoEnviron(t *testing.T) {
+	dist := Distribution{GOOS: "linux", GOARCH: "arm64"}
+	var envs CgoEnvs
+	for _, val := range []string{"linux/*:CC=gcc", "linux/arm64:CC=aarch64-linux-gnu-gcc", "windows/*:AR=ar"} {
+		if err := envs.Set(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env, err := cgoEnviron("zig", envs, dist, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"CC":  "aarch64-linux-gnu-gcc",
+		"CXX": "zig c++ -target aarch64-linux-musl",
+		"AR":  "zig ar",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %v, want %v", env, want)
+	}
+	freebsd := Distribution{GOOS: "freebsd", GOARCH: "amd64"}
+	if _, err = cgoEnviron("zig", nil, freebsd, false); err == nil {
+		t.Error("expected an error for a target zig doesn't support")
+	}
+	// An explicit CC covers targets the preset doesn't support
+	if _, err = cgoEnviron("zig", CgoEnvs{{Pattern: "freebsd/*", Key: "CC", Value: "cc"}}, freebsd, false); err != nil {
+		t.Errorf("explicit CC failed: %s", err)
+	}
+	if _, err = cgoEnviron("gcc", nil, dist, false); err == nil {
+		t.Error("expected an error for an unknown preset")
+	}
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Targets UPX can compress. Others like darwin/arm64 produce binaries which
+// don't run.
+var upxTargets = []string{
+	"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/mips", "linux/mipsle", "linux/ppc64le",
+	"windows/386", "windows/amd64",
+}
+
+type CompressConfig struct {
+	// Compressor command which modifies the binary in place. The binary is
+	// appended unless an argument uses {{.ARTIFACT}}. Ex: upx --best
+	Command string
+	// Target patterns like linux/* the compressor supports
+	Targets StringSlice
+}
+
+// The size of a binary before and after compression
+type CompressedSize struct {
+	Original   int64
+	Compressed int64
+}
+
+func (s CompressedSize) String() string {
+	percent := 100.0
+	if s.Original > 0 {
+		percent = float64(s.Compressed) / float64(s.Original) * 100
+	}
+	return fmt.Sprintf("%s -> %s (%.0f%%)", FormatSize(s.Original), FormatSize(s.Compressed), percent)
+}
+
+// Format a size in bytes using binary units
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// The target patterns the compressor supports. UPX defaults to the targets it
+// is known to work on and any other compressor to every target.
+func (c CompressConfig) targets() []string {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	fields, _ := SplitArgs(c.Command)
+	if len(fields) > 0 && strings.TrimSuffix(path.Base(strings.ReplaceAll(fields[0], `\`, "/")), ".exe") == "upx" {
+		return upxTargets
+	}
+	return []string{"*"}
+}
+
+// Check if the compressor should run for a distribution
+func (c CompressConfig) Supports(dist Distribution) bool {
+	if c.Command == "" {
+		return false
+	}
+	for _, pattern := range c.targets() {
+		if ok, _ := path.Match(pattern, dist.GOOS+"/"+dist.GOARCH); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the compressor exists before building
+func (c CompressConfig) Check() (err error) {
+	fields, err := SplitArgs(c.Command)
+	if err != nil || len(fields) == 0 {
+		return fmt.Errorf("invalid compressor %q", c.Command)
+	}
+	if _, err = exec.LookPath(fields[0]); err != nil {
+		return fmt.Errorf("compressor not found: %s", fields[0])
+	}
+	return
+}
+
+// Compress a binary in place and report its size before and after
+func Compress(config BuildConfig, data map[string]string, loc string) (size CompressedSize, err error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return
+	}
+	size.Original = info.Size()
+	fields, err := SplitArgs(config.Compression.Command)
+	if err != nil {
+		return
+	}
+	args := make([]string, len(fields))
+	hasArtifact := false
+	for i, field := range fields {
+		hasArtifact = hasArtifact || strings.Contains(field, ".ARTIFACT")
+		tmpl, err := template.New("compress").Parse(field)
+		if err != nil {
+			return size, err
+		}
+		if args[i], err = RenderString(tmpl, data); err != nil {
+			return size, err
+		}
+	}
+	if !hasArtifact {
+		args = append(args, loc)
+	}
+	if config.Verbose {
+		fmt.Printf("running %s\n", strings.Join(args, " "))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = config.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return size, fmt.Errorf("failed to compress %s: %w\n%s", loc, err, out)
+	}
+	if info, err = os.Stat(loc); err != nil {
+		return
+	}
+	size.Compressed = info.Size()
+	return
+}
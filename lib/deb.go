@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var debianArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "amd64",
+	"arm":      "armhf",
+	"arm64":    "arm64",
+	"loong64":  "loong64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64le": "mips64el",
+	"ppc64le":  "ppc64el",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// Map GOARCH to the Debian architecture name
+func DebianArch(goarch string) (arch string, ok bool) {
+	arch, ok = debianArchs[goarch]
+	return
+}
+
+// The file name of a Debian package like name_1.2.3-1_amd64.deb
+func DebName(p Package, arch string) string {
+	return fmt.Sprintf("%s_%s-%s_%s.deb", p.Name, p.Version, p.Release, arch)
+}
+
+// Write a Debian package. The package is an ar archive of debian-binary,
+// control.tar.gz and data.tar.gz.
+func WriteDeb(finalPath string, p Package, arch string) (err error) {
+	data, sums, size, err := debData(p)
+	if err != nil {
+		return
+	}
+	control, err := debControl(p, arch, sums, size)
+	if err != nil {
+		return
+	}
+	outf, err := os.Create(finalPath)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	if _, err = io.WriteString(outf, "!<arch>\n"); err != nil {
+		return
+	}
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", control},
+		{"data.tar.gz", data},
+	}
+	for _, m := range members {
+		if err = writeArMember(outf, m.name, m.data, p.ModTime); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeArMember(w io.Writer, name string, data []byte, modTime time.Time) (err error) {
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, modTime.Unix(), 0, 0, "100644", len(data))
+	if _, err = io.WriteString(w, header); err != nil {
+		return
+	}
+	if _, err = w.Write(data); err != nil {
+		return
+	}
+	// Members are aligned to an even offset
+	if len(data)%2 == 1 {
+		_, err = w.Write([]byte{'\n'})
+	}
+	return
+}
+
+// Create the data tarball with the md5sums of the files and the installed
+// size in KiB
+func debData(p Package) (data []byte, sums string, size int64, err error) {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	writer := tar.NewWriter(gz)
+	err = writePackageFiles(writer, p, "./", func(hdr *tar.Header, content []byte) {
+		sum := md5.Sum(content)
+		sums += hex.EncodeToString(sum[:]) + "  " + strings.TrimPrefix(hdr.Name, "./") + "\n"
+		size += (int64(len(content)) + 1023) / 1024
+	})
+	if err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), sums, size, nil
+}
+
+// Create the control tarball with the control file, md5sums, conffiles and
+// maintainer scripts
+func debControl(p Package, arch, sums string, size int64) (data []byte, err error) {
+	scripts, err := p.Scripts()
+	if err != nil {
+		return
+	}
+	files := []controlFile{
+		{"control", debControlFile(p, arch, size), 0644},
+		{"md5sums", sums, 0644},
+	}
+	// Files in /etc are kept when the package is upgraded or removed
+	conffiles := ""
+	for _, f := range p.Files {
+		if strings.HasPrefix(f.Dest, "/etc/") {
+			conffiles += f.Dest + "\n"
+		}
+	}
+	if conffiles != "" {
+		files = append(files, controlFile{"conffiles", conffiles, 0644})
+	}
+	for _, s := range []struct{ name, script string }{
+		{"preinst", "preinstall"},
+		{"postinst", "postinstall"},
+		{"prerm", "preremove"},
+		{"postrm", "postremove"},
+	} {
+		if content, ok := scripts[s.script]; ok {
+			files = append(files, controlFile{s.name, content, 0755})
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	writer := tar.NewWriter(gz)
+	for _, f := range files {
+		err = writer.WriteHeader(&tar.Header{
+			Name:    "./" + f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.content)),
+			ModTime: p.ModTime,
+		})
+		if err != nil {
+			return
+		}
+		if _, err = io.WriteString(writer, f.content); err != nil {
+			return
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+func debControlFile(p Package, arch string, size int64) string {
+	b := strings.Builder{}
+	field := func(key, val string) {
+		if val != "" {
+			fmt.Fprintf(&b, "%s: %s\n", key, val)
+		}
+	}
+	maintainer := p.Config.Maintainer
+	if maintainer == "" {
+		maintainer = "unknown"
+	}
+	field("Package", p.Name)
+	field("Version", p.Version+"-"+p.Release)
+	field("Architecture", arch)
+	field("Maintainer", maintainer)
+	field("Installed-Size", fmt.Sprint(size))
+	depends := make([]string, len(p.Config.Depends))
+	for i, dep := range p.Config.Depends {
+		depends[i] = debDependency(dep)
+	}
+	field("Depends", strings.Join(depends, ", "))
+	field("Section", "utils")
+	field("Priority", "optional")
+	field("Homepage", p.Config.Homepage)
+	field("Description", debDescription(p))
+	return b.String()
+}
+
+// Format a dependency like "name >= 1.0" as "name (>= 1.0)". Debian spells
+// the strict comparisons as >> and <<.
+func debDependency(dep string) string {
+	name, op, version := SplitDependency(dep)
+	switch op {
+	case "":
+		return name
+	case ">":
+		op = ">>"
+	case "<":
+		op = "<<"
+	}
+	return fmt.Sprintf("%s (%s %s)", name, op, version)
+}
+
+// The first line of the description is the synopsis and each following line
+// is indented with empty lines replaced by a dot
+func debDescription(p Package) string {
+	desc := strings.TrimSpace(p.Config.Description)
+	if desc == "" {
+		desc = p.Name
+	}
+	lines := strings.Split(desc, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		if line == "" {
+			line = "."
+		}
+		lines[i] = " " + line
+	}
+	return strings.Join(lines, "\n")
+}
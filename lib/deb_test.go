@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type arMember struct {
+	name string
+	data []byte
+}
+
+// Read the members of an ar archive
+func readAr(t *testing.T, data []byte) (members []arMember) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatal("missing ar magic")
+	}
+	data = data[8:]
+	for len(data) > 0 {
+		if len(data) < 60 || string(data[58:60]) != "`\n" {
+			t.Fatalf("invalid ar header %q", data[:min(len(data), 60)])
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if err != nil || 60+size > len(data) {
+			t.Fatalf("invalid ar member size %q", data[48:58])
+		}
+		members = append(members, arMember{name: strings.TrimSpace(string(data[:16])), data: data[60 : 60+size]})
+		data = data[60+size+size%2:]
+	}
+	return
+}
+
+// Read the files of a gzipped tarball by their name
+func readTarGz(t *testing.T, data []byte) (files map[string]*tar.Header, contents map[string]string) {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, contents = map[string]*tar.Header{}, map[string]string{}
+	reader := tar.NewReader(gz)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = hdr
+		contents[hdr.Name] = string(content)
+	}
+}
+
+func TestWriteDeb(t *testing.T) {
+	p := testPackage(t)
+	loc := filepath.Join(t.TempDir(), DebName(p, "amd64"))
+	if err := WriteDeb(loc, p, "amd64"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := readAr(t, data)
+	if len(members) != 3 || members[0].name != "debian-binary" || members[1].name != "control.tar.gz" || members[2].name != "data.tar.gz" {
+		t.Fatalf("unexpected members %v", members)
+	}
+	if string(members[0].data) != "2.0\n" {
+		t.Errorf("unexpected debian-binary %q", members[0].data)
+	}
+
+	dataFiles, dataContents := readTarGz(t, members[2].data)
+	for _, f := range p.Files {
+		name := "." + f.Dest
+		hdr, ok := dataFiles[name]
+		if !ok {
+			t.Errorf("missing %s in data.tar.gz", name)
+			continue
+		}
+		if hdr.Mode&0777 != int64(f.Mode) || !hdr.ModTime.Equal(p.ModTime) {
+			t.Errorf("unexpected header for %s: mode %o, time %s", name, hdr.Mode, hdr.ModTime)
+		}
+		content, _ := os.ReadFile(f.Src)
+		if dataContents[name] != string(content) {
+			t.Errorf("unexpected content for %s: %q", name, dataContents[name])
+		}
+	}
+	for _, dir := range p.Dirs() {
+		if hdr, ok := dataFiles["."+dir+"/"]; !ok || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("missing directory %s in data.tar.gz", dir)
+		}
+	}
+
+	_, control := readTarGz(t, members[1].data)
+	wantControl := `Package: app
+Version: 1.2.3-1
+Architecture: amd64
+Maintainer: Jane Doe <jane@example.com>
+Installed-Size: 2
+Depends: libc6 (>= 2.31), ca-certificates
+Section: utils
+Priority: optional
+Homepage: https://example.com
+Description: An app
+ It does things.
+ .
+ Really.
+`
+	if control["./control"] != wantControl {
+		t.Errorf("unexpected control file:\n%s", control["./control"])
+	}
+	if control["./conffiles"] != "/etc/app/conf.yml\n" {
+		t.Errorf("unexpected conffiles %q", control["./conffiles"])
+	}
+	if control["./postinst"] != "#!/bin/sh\necho installed\n" {
+		t.Errorf("unexpected postinst %q", control["./postinst"])
+	}
+	for _, line := range strings.Split(strings.TrimSpace(control["./md5sums"]), "\n") {
+		sum, name, _ := strings.Cut(line, "  ")
+		want := md5.Sum([]byte(dataContents["./"+name]))
+		if sum != hex.EncodeToString(want[:]) {
+			t.Errorf("md5sum mismatch for %s", name)
+		}
+	}
+	if n := len(strings.Split(strings.TrimSpace(control["./md5sums"]), "\n")); n != len(p.Files) {
+		t.Errorf("expected %d md5sums, got %d", len(p.Files), n)
+	}
+}
+
+func TestDebDependency(t *testing.T) {
+	cases := map[string]string{
+		"libc6":           "libc6",
+		"libc6 >= 2.31":   "libc6 (>= 2.31)",
+		"libc6 (>= 2.31)": "libc6 (>= 2.31)",
+		"libc6>2.31":      "libc6 (>> 2.31)",
+		"libc6 < 3":       "libc6 (<< 3)",
+		"libc6 >> 2.31":   "libc6 (>> 2.31)",
+		"libc6 <= 3":      "libc6 (<= 3)",
+		"libc6 = 2.31-1":  "libc6 (= 2.31-1)",
+	}
+	for dep, want := range cases {
+		if got := debDependency(dep); got != want {
+			t.Errorf("debDependency(%q) = %q, want %q", dep, got, want)
+		}
+	}
+}
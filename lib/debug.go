@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DebugExt = ".debug.tar.gz"
+
+// Render the path of the debug artifact for a bundle. The ZIP extension is
+// replaced by .debug.tar.gz.
+func RenderDebugPath(config BuildConfig, dist Distribution, bin Binary) (string, error) {
+	data := TemplateData(config, dist, bin)
+	data["ZIP"] = ""
+	finalPath, err := renderBundlePath(config, data)
+	return finalPath + DebugExt, err
+}
+
+// Read the Go build ID of a binary
+func ReadBuildID(config BuildConfig, loc string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	cmd := GoCommand(config, "tool", "buildid", loc)
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to read build ID of %s: %w\n%s", loc, err, errBuf.String())
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Find the debug artifact which belongs to a bundle
+func DebugArtifact(artifacts []Artifact, bundle Artifact) (a Artifact, ok bool) {
+	for _, a := range artifacts {
+		if a.Kind == ArtifactDebug && a.GOOS == bundle.GOOS && a.GOARCH == bundle.GOARCH && a.GoVersion == bundle.GoVersion &&
+			strings.Join(a.Binaries, ",") == strings.Join(bundle.Binaries, ",") {
+			return a, true
+		}
+	}
+	return
+}
+
+// Read the debug binaries of a debug artifact by the names of the binaries
+func readDebugBinaries(config BuildConfig, a Artifact, names []string) (files []ociFile, err error) {
+	inf, err := os.Open(filepath.Join(config.OutputDir, filepath.FromSlash(a.Path)))
+	if err != nil {
+		return
+	}
+	defer inf.Close()
+	gz, err := gzip.NewReader(inf)
+	if err != nil {
+		return
+	}
+	reader := tar.NewReader(gz)
+	found := map[string][]byte{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if found[header.Name], err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		data, ok := found[name+".debug"]
+		if !ok {
+			return nil, fmt.Errorf("failed to read %s.debug from %s", name, a.Name)
+		}
+		files = append(files, ociFile{Name: name + ".debug", Mode: 0755, Content: data})
+	}
+	return
+}
+
+// Write the entries to a gzipped tarball
+func BundleTarGz(finalPath string, entries []BundleEntry, config BuildConfig) (err error) {
+	if config.Verbose {
+		fmt.Println("finalPath", finalPath)
+	}
+	outf, err := os.Create(finalPath)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	gz, err := gzip.NewWriterLevel(outf, gzip.BestCompression)
+	if err != nil {
+		return
+	}
+	writer := tar.NewWriter(gz)
+	if config.Reproducible {
+		entries = append([]BundleEntry{}, entries...)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	for _, entry := range entries {
+		if err = addTarFile(writer, entry, config); err != nil {
+			return
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return outf.Close()
+}
+
+func addTarFile(writer *tar.Writer, entry BundleEntry, config BuildConfig) (err error) {
+	inF, err := os.Open(entry.Path)
+	if err != nil {
+		return
+	}
+	defer inF.Close()
+	info, err := inF.Stat()
+	if err != nil {
+		return
+	}
+	modTime := info.ModTime()
+	if config.Reproducible {
+		modTime = config.SourceDate
+	}
+	err = writer.WriteHeader(&tar.Header{
+		Name:    entry.Name,
+		Mode:    0755,
+		Size:    info.Size(),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(writer, inF)
+	return
+}
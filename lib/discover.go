@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type MainPackage struct {
+	ImportPath string
+	// Path relative to the working directory in the form of ./cmd/name
+	Package string
+}
+
+// The default binary for a main package
+func (m MainPackage) Binary() Binary {
+	return Binary{Name: path.Base(m.ImportPath), Package: m.Package}
+}
+
+type MainPackages []MainPackage
+
+func (m MainPackages) String() string {
+	vals := make([]string, len(m))
+	for i, pkg := range m {
+		vals[i] = pkg.Package
+	}
+	return strings.Join(vals, ", ")
+}
+
+// Find all of the main packages in the module using go list. The package
+// paths are relative to the configured directory.
+func FindMainPackages(config BuildConfig) (res MainPackages, err error) {
+	wd, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	// Packages which fail to load are skipped instead of failing the listing
+	cmd := GoCommand(config, "list", "-e", "-f", `{{if and (not .Error) (eq .Name "main")}}{{.ImportPath}} {{.Dir}}{{end}}`, "./...")
+	cmd.Dir = config.Module.Dir
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+	if err = cmd.Run(); err != nil {
+		return res, fmt.Errorf("failed to list packages: %w\n%s", err, errBuf.String())
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		importPath, dir, found := StringCut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		rel, err := filepath.Rel(wd, dir)
+		if err != nil {
+			return res, err
+		}
+		pkg := filepath.ToSlash(rel)
+		if pkg != "." && pkg != ".." && !strings.HasPrefix(pkg, "../") {
+			pkg = "./" + pkg
+		}
+		res = append(res, MainPackage{ImportPath: importPath, Package: pkg})
+	}
+	return
+}
+
+// Pick the main package to build when none are specified. This is either the
+// root package, the only package in cmd/* or the only main package overall.
+func DefaultMainPackage(modPath string, pkgs MainPackages) (res MainPackage, err error) {
+	var cmds MainPackages
+	for _, pkg := range pkgs {
+		if pkg.ImportPath == modPath {
+			return pkg, nil
+		}
+		if path.Dir(pkg.ImportPath) == modPath+"/cmd" {
+			cmds = append(cmds, pkg)
+		}
+	}
+	switch {
+	case len(cmds) == 1:
+		return cmds[0], nil
+	case len(pkgs) == 1:
+		return pkgs[0], nil
+	case len(pkgs) == 0:
+		err = fmt.Errorf("no main packages found")
+	default:
+		err = fmt.Errorf("multiple main packages found, select them with -bin: %s", pkgs)
+	}
+	return
+}
@@ -12,7 +12,7 @@ type Distribution struct {
 	GOARCH       string
 	FirstClass   bool
 	CgoSupported bool
-	BuildPath    string
+	BuildPaths   []string
 }
 
 // func (d Distribution) String() string {
@@ -75,7 +75,7 @@ func (d DistributionSet) Copy() (res DistributionSet) {
 
 func (d DistributionSet) Has(val Distribution) bool {
 	for _, dist := range d {
-		if dist == val {
+		if dist.GOOS == val.GOOS && dist.GOARCH == val.GOARCH {
 			return true
 		}
 	}
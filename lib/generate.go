@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+type EnvVars []string
+
+// Add a variable in the form of KEY=VALUE
+func (e *EnvVars) Set(val string) error {
+	if key, _, found := StringCut(val, "="); !found || key == "" {
+		return fmt.Errorf("invalid environment variable %q: expected KEY=VALUE", val)
+	}
+	*e = append(*e, val)
+	return nil
+}
+
+func (e *EnvVars) String() string {
+	return strings.Join(*e, " ")
+}
+
+type GenerateConfig struct {
+	// Package patterns to generate. Defaults to ./...
+	Packages StringSlice
+	// Regular expressions passed to -run and -skip
+	Run  string
+	Skip string
+	// Additional KEY=VALUE environment variables
+	Env EnvVars
+	// Run generate before each target with its GOOS and GOARCH
+	PerTarget bool
+}
+
+// Create the go generate command. When dist is set the command targets its
+// GOOS and GOARCH.
+func GenerateCommand(config BuildConfig, dist *Distribution) *exec.Cmd {
+	gen := config.Generation
+	args := []string{"generate"}
+	if gen.Run != "" {
+		args = append(args, "-run", gen.Run)
+	}
+	if gen.Skip != "" {
+		args = append(args, "-skip", gen.Skip)
+	}
+	args = append(args, tagArgs(config.BuildArgs)...)
+	if len(gen.Packages) == 0 {
+		args = append(args, "./...")
+	} else {
+		args = append(args, gen.Packages...)
+	}
+	cmd := GoCommand(config, args...)
+	cmd.Env = append(cmd.Env, gen.Env...)
+	if dist != nil {
+		cmd.Env = append(cmd.Env, "GOOS="+dist.GOOS, "GOARCH="+dist.GOARCH)
+	}
+	return cmd
+}
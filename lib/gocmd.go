@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// Create a go command which runs in the configured directory, workspace and
+// toolchain
+func GoCommand(config BuildConfig, args ...string) *exec.Cmd {
+	goBin := "go"
+	if config.Toolchain.GoBin != "" {
+		goBin = config.Toolchain.GoBin
+	}
+	cmd := exec.CommandContext(context.Background(), goBin, args...)
+	cmd.Dir = config.Dir
+	cmd.Env = os.Environ()
+	if config.GoWork != "" {
+		cmd.Env = append(cmd.Env, "GOWORK="+config.GoWork)
+	}
+	if config.Toolchain.Name != "" {
+		cmd.Env = append(cmd.Env, "GOTOOLCHAIN="+config.Toolchain.Name)
+	}
+	return cmd
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+var formulaTemplate = template.Must(template.New("formula").Funcs(template.FuncMap{
+	"quote": rubyQuote,
+}).Parse(`class {{.Class}} < Formula
+  desc {{quote .Desc}}
+{{- if .Homepage}}
+  homepage {{quote .Homepage}}
+{{- end}}
+  version {{quote .Version}}
+{{- if .License}}
+  license {{quote .License}}
+{{- end}}
+{{range .Systems}}
+  on_{{.OS}} do
+{{- range .Archs}}
+    on_{{.CPU}} do
+{{- if .Only64}}
+      if Hardware::CPU.is_64_bit?
+        url {{quote .URL}}
+        sha256 {{quote .SHA256}}
+      end
+{{- else}}
+      url {{quote .URL}}
+      sha256 {{quote .SHA256}}
+{{- end}}
+    end
+{{- end}}
+  end
+{{end}}
+  def install
+{{- range .Binaries}}
+    bin.install {{quote .}}
+{{- end}}
+  end
+
+  test do
+    {{.Test}}
+  end
+end
+`))
+
+type formulaArch struct {
+	CPU    string
+	URL    string
+	SHA256 string
+	// Linux arm also matches 32 bit arm
+	Only64 bool
+}
+
+type formulaSystem struct {
+	OS    string
+	Archs []formulaArch
+}
+
+type Formula struct {
+	Class    string
+	Desc     string
+	Homepage string
+	Version  string
+	License  string
+	Systems  []formulaSystem
+	Binaries []string
+	Test     string
+}
+
+// Convert a formula name like my-tool into its class name MyTool
+func FormulaClass(name string) string {
+	name = strings.ReplaceAll(name, "+", "x")
+	name = strings.ReplaceAll(name, "@", "AT")
+	b := strings.Builder{}
+	upper := true
+	for _, r := range name {
+		if r == '-' || r == '_' || r == '.' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+		}
+		b.WriteRune(r)
+		upper = false
+	}
+	return b.String()
+}
+
+func rubyQuote(val string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `#{`, `\#{`).Replace(val) + `"`
+}
+
+// Create the formula for the darwin and linux bundles of a group
+func NewFormula(config BuildConfig, group PublishGroup) (f Formula, ok bool, err error) {
+	f = Formula{
+		Class:    FormulaClass(group.Name),
+		Desc:     config.Packaging.Description,
+		Homepage: config.Packaging.Homepage,
+		Version:  PublishVersion(config),
+		License:  config.Packaging.License,
+		Test:     config.Publish.HomebrewTest,
+	}
+	if f.Desc, _, _ = StringCut(strings.TrimSpace(f.Desc), "\n"); f.Desc == "" {
+		f.Desc = group.Name
+	}
+	for _, goos := range []string{"darwin", "linux"} {
+		system := formulaSystem{OS: goos}
+		if goos == "darwin" {
+			system.OS = "macos"
+		}
+		for _, arch := range []struct{ goarch, cpu string }{{"arm64", "arm"}, {"amd64", "intel"}} {
+			a, found := group.Artifact(goos, arch.goarch)
+			if !found && goos == "darwin" {
+				a, found = group.Artifact(goos, UniversalArch)
+			}
+			if !found {
+				continue
+			}
+			url, err := group.URL(config, a)
+			if err != nil {
+				return f, false, err
+			}
+			system.Archs = append(system.Archs, formulaArch{
+				CPU:    arch.cpu,
+				URL:    url,
+				SHA256: a.SHA256,
+				Only64: goos == "linux" && arch.goarch == "arm64",
+			})
+			if f.Binaries == nil {
+				if f.Binaries, err = group.BinaryNames(config, a.Distribution()); err != nil {
+					return f, false, err
+				}
+			}
+		}
+		if len(system.Archs) > 0 {
+			f.Systems = append(f.Systems, system)
+		}
+	}
+	if len(f.Systems) == 0 {
+		return f, false, nil
+	}
+	if f.Test == "" {
+		f.Test = fmt.Sprintf(`system "#{bin}/%s", "--version"`, f.Binaries[0])
+	}
+	return f, true, nil
+}
+
+// Write the formula to the Formula directory of the tap
+func WriteFormula(tap, name string, f Formula) (loc string, err error) {
+	loc = filepath.Join(tap, "Formula", name+".rb")
+	if err = os.MkdirAll(filepath.Dir(loc), 0755); err != nil {
+		return
+	}
+	return loc, writeTemplateFile(loc, formulaTemplate, f)
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+const (
+	HookBeforeAll    = "before-all"
+	HookBeforeTarget = "before-target"
+	HookAfterBuild   = "after-build"
+	HookAfterBundle  = "after-bundle"
+	HookAfterAll     = "after-all"
+)
+
+var hookStages = []string{HookBeforeAll, HookBeforeTarget, HookAfterBuild, HookAfterBundle, HookAfterAll}
+
+type Hook struct {
+	Stage string
+	// Command and arguments which are rendered as templates
+	Command string
+}
+
+type Hooks []Hook
+
+// Parse a hook in the form of stage:command
+func (h *Hooks) Set(val string) error {
+	stage, command, found := StringCut(val, ":")
+	if !found || strings.TrimSpace(command) == "" {
+		return fmt.Errorf("invalid hook %q: expected stage:command", val)
+	}
+	if !StringSliceContains(hookStages, stage) {
+		return fmt.Errorf("invalid hook %q: stage must be one of %s", val, strings.Join(hookStages, ", "))
+	}
+	*h = append(*h, Hook{Stage: stage, Command: command})
+	return nil
+}
+
+func (h *Hooks) String() string {
+	vals := make([]string, len(*h))
+	for i, hook := range *h {
+		vals[i] = hook.Stage + ":" + hook.Command
+	}
+	return strings.Join(vals, ",")
+}
+
+// Run the hooks for a stage in order. The template data is also passed to the
+// command as GBUILD_* environment variables.
+func (h Hooks) Run(stage string, config BuildConfig, data map[string]string) (err error) {
+	for _, hook := range h {
+		if hook.Stage != stage {
+			continue
+		}
+		if err = hook.run(config, data); err != nil {
+			return fmt.Errorf("%s hook failed: %w", stage, err)
+		}
+	}
+	return
+}
+
+func (h Hook) run(config BuildConfig, data map[string]string) (err error) {
+	fields, err := SplitArgs(h.Command)
+	if err != nil {
+		return
+	}
+	args := make([]string, len(fields))
+	for i, field := range fields {
+		tmpl, err := template.New("hook").Parse(field)
+		if err != nil {
+			return err
+		}
+		if args[i], err = RenderString(tmpl, data); err != nil {
+			return err
+		}
+	}
+	if config.Verbose {
+		fmt.Printf("running %s hook: %s\n", h.Stage, strings.Join(args, " "))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = config.Dir
+	cmd.Env = os.Environ()
+	for key, val := range data {
+		cmd.Env = append(cmd.Env, "GBUILD_"+key+"="+val)
+	}
+	cmd.Env = append(cmd.Env, "GBUILD_STAGE="+h.Stage)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const ManifestName = "manifest.json"
+
+type Artifact struct {
+	// File name of the artifact
+	Name string
+	// Location relative to the output directory
+	Path      string
+	Kind      string
+	GOOS      string
+	GOARCH    string
+	GoVersion string
+	Binaries  []string
+	// Build ID of each binary shared by the shipping and debug artifacts
+	BuildIDs map[string]string `json:",omitempty"`
+	// Size of each compressed binary before and after compression
+	Sizes  map[string]CompressedSize `json:",omitempty"`
+	SHA256 string
+}
+
+const (
+	ArtifactBundle = "bundle"
+	ArtifactDebug  = "debug"
+)
+
+type Manifest struct {
+	Artifacts []Artifact
+}
+
+// Create an artifact for a file and compute its hash
+func NewArtifact(loc, kind string, dist Distribution, config BuildConfig, bins Binaries) (a Artifact, err error) {
+	rel, err := filepath.Rel(config.OutputDir, loc)
+	if err != nil {
+		return
+	}
+	a = Artifact{
+		Name:      filepath.Base(loc),
+		Path:      filepath.ToSlash(rel),
+		Kind:      kind,
+		GOOS:      dist.GOOS,
+		GOARCH:    dist.GOARCH,
+		GoVersion: config.Toolchain.Version,
+	}
+	for _, bin := range bins {
+		a.Binaries = append(a.Binaries, bin.Name)
+	}
+	a.SHA256, err = HashFile(loc)
+	return
+}
+
+// Write the manifest to the output directory
+func WriteManifest(dir string, m Manifest) (err error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestName), data, 0644)
+}
+
+// Read the manifest from the output directory
+func ReadManifest(dir string) (m Manifest, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &m)
+	return
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+var ErrNoModule = errors.New("no go.mod file found")
+
+type GoModule struct {
+	// Executable name derived from the module path
+	Name string
+	// Full module path
+	Path string
+	// Directory containing the go.mod file
+	Dir       string
+	GoVersion string
+	Toolchain string
+	Replace   []*modfile.Replace
+	Retract   []*modfile.Retract
+}
+
+// Parse the module path, go version, toolchain and replace/retract directives
+// from a go.mod file
+func ParseMod(loc string) (mod GoModule, err error) {
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		return
+	}
+	f, err := modfile.Parse(loc, data, nil)
+	if err != nil {
+		return
+	}
+	if f.Module == nil {
+		err = fmt.Errorf("missing module directive in %s", loc)
+		return
+	}
+	mod.Path = f.Module.Mod.Path
+	mod.Name = moduleName(mod.Path)
+	mod.Dir = filepath.Dir(loc)
+	if f.Go != nil {
+		mod.GoVersion = f.Go.Version
+	}
+	if f.Toolchain != nil {
+		mod.Toolchain = f.Toolchain.Name
+	}
+	mod.Replace = f.Replace
+	mod.Retract = f.Retract
+	return
+}
+
+// The last element of the module path without a major version suffix
+func moduleName(modPath string) string {
+	prefix, _, ok := module.SplitPathVersion(modPath)
+	if !ok {
+		prefix = modPath
+	}
+	return path.Base(prefix)
+}
+
+// Find the go.mod file by walking up from dir
+func FindModFile(dir string) (loc string, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	for {
+		loc = filepath.Join(dir, "go.mod")
+		if info, err := os.Stat(loc); err == nil && !info.IsDir() {
+			return loc, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNoModule
+		}
+		dir = parent
+	}
+}
+
+func ApplyModule(config *BuildConfig) (mod GoModule, err error) {
+	loc, err := FindModFile(config.Dir)
+	if err != nil {
+		// It's not strictly necessary that the "go.mod" file should exist
+		if errors.Is(err, ErrNoModule) {
+			err = nil
+		}
+		return
+	}
+	if mod, err = ParseMod(loc); err != nil {
+		return
+	}
+	if config.Name == "" {
+		config.Name = mod.Name
+	}
+	config.Module = mod
+	return
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModuleName(t *testing.T) {
+	cases := map[string]string{
+		"demo":                         "demo",
+		"example.com/demo":             "demo",
+		"github.com/user/tool/v2":      "tool",
+		"github.com/user/tool/cmd/v10": "cmd",
+		"gopkg.in/yaml.v3":             "yaml",
+	}
+	for modPath, want := range cases {
+		if got := moduleName(modPath); got != want {
+			t.Errorf("moduleName(%q) = %q, want %q", modPath, got, want)
+		}
+	}
+}
+
+func TestParseMod(t *testing.T) {
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "go.mod")
+	content := `module github.com/user/tool/v2
+
+go 1.21
+
+toolchain go1.22.3
+
+require golang.org/x/mod v0.17.0
+
+replace golang.org/x/mod => ../mod
+
+retract v2.0.1
+`
+	if err := os.WriteFile(loc, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := ParseMod(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.Path != "github.com/user/tool/v2" || mod.Name != "tool" || mod.Dir != dir {
+		t.Errorf("unexpected module %+v", mod)
+	}
+	if mod.GoVersion != "1.21" || mod.Toolchain != "go1.22.3" {
+		t.Errorf("unexpected versions %q and %q", mod.GoVersion, mod.Toolchain)
+	}
+	if len(mod.Replace) != 1 || mod.Replace[0].New.Path != "../mod" {
+		t.Errorf("unexpected replace directives %+v", mod.Replace)
+	}
+	if len(mod.Retract) != 1 || mod.Retract[0].Low != "v2.0.1" {
+		t.Errorf("unexpected retract directives %+v", mod.Retract)
+	}
+}
+
+func TestParseModWithoutModule(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "go.mod")
+	if err := os.WriteFile(loc, []byte("go 1.21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseMod(loc); err == nil {
+		t.Error("expected an error without a module directive")
+	}
+}
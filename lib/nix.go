@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var nixSystems = map[string]string{
+	"linux/386":     "i686-linux",
+	"linux/amd64":   "x86_64-linux",
+	"linux/arm":     "armv7l-linux",
+	"linux/arm64":   "aarch64-linux",
+	"linux/ppc64le": "powerpc64le-linux",
+	"linux/riscv64": "riscv64-linux",
+	"darwin/amd64":  "x86_64-darwin",
+	"darwin/arm64":  "aarch64-darwin",
+}
+
+// Map a distribution to the Nix system
+func NixSystem(dist Distribution) (system string, ok bool) {
+	system, ok = nixSystems[dist.GOOS+"/"+dist.GOARCH]
+	return
+}
+
+var nixTemplates = template.Must(template.New("nix").Funcs(template.FuncMap{
+	"quote": nixQuote,
+	"arg":   nixShellArg,
+}).Parse(`
+{{- define "derivation" -}}
+# Generated by gbuild. The defaults let nix-build use the file directly.
+{ pkgs ? import <nixpkgs> { }
+, stdenvNoCC ? pkgs.stdenvNoCC
+, fetchurl ? pkgs.fetchurl
+, unzip ? pkgs.unzip
+}:
+
+let
+  sources = {
+{{- range .Sources}}
+    {{quote .System}} = fetchurl {
+      url = {{quote .URL}};
+      hash = {{quote .Hash}};
+    };
+{{- end}}
+  };
+  system = stdenvNoCC.hostPlatform.system;
+in
+stdenvNoCC.mkDerivation {
+  pname = {{quote .Name}};
+  version = {{quote .Version}};
+
+  src = sources.${system} or (throw ({{quote .Name}} + " is not available for ${system}"));
+
+  nativeBuildInputs = [ unzip ];
+  sourceRoot = ".";
+
+  installPhase = ''
+    runHook preInstall
+{{- range .Binaries}}
+    install -Dm755 {{arg .}} $out/bin/{{arg .}}
+{{- end}}
+    runHook postInstall
+  '';
+
+  meta = {
+    description = {{quote .Description}};
+{{- if .Homepage}}
+    homepage = {{quote .Homepage}};
+{{- end}}
+    platforms = [{{range .Sources}} {{quote .System}}{{end}} ];
+    mainProgram = {{quote (index .Binaries 0)}};
+  };
+}
+{{end}}
+
+{{- define "flake" -}}
+# Generated by gbuild
+{
+  inputs.nixpkgs.url = "github:NixOS/nixpkgs/nixos-unstable";
+
+  outputs = { self, nixpkgs }:
+    let
+      systems = [{{range .Systems}} {{quote .}}{{end}} ];
+      forAllSystems = f: nixpkgs.lib.genAttrs systems (system: f nixpkgs.legacyPackages.${system});
+    in
+    {
+      packages = forAllSystems (pkgs: {
+{{- range .Derivations}}
+        {{quote .Name}} = pkgs.callPackage ./{{.File}} { };
+{{- end}}
+        default = pkgs.callPackage ./default.nix { };
+      });
+    };
+}
+{{end}}
+`))
+
+type nixSource struct {
+	System string
+	URL    string
+	// SRI hash like sha256-...
+	Hash string
+}
+
+type NixDerivation struct {
+	Name        string
+	Version     string
+	Description string
+	Homepage    string
+	Binaries    []string
+	Sources     []nixSource
+	// File name of the derivation in the output directory. Set by WriteNix.
+	File string
+}
+
+func nixQuote(val string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`).Replace(val) + `"`
+}
+
+// Quote a shell argument inside of an indented string like the installPhase
+func nixShellArg(val string) string {
+	if strings.Trim(val, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._+-") != "" {
+		val = "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+	}
+	return strings.NewReplacer("''", "'''", "${", "''${").Replace(val)
+}
+
+// Convert a hex sha256 digest into an SRI hash
+func SRIHash(sha256Hex string) (string, error) {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return "", err
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// Create the derivation for the linux and darwin bundles of a group
+func NewNixDerivation(config BuildConfig, group PublishGroup) (d NixDerivation, ok bool, err error) {
+	desc, _, _ := StringCut(strings.TrimSpace(config.Packaging.Description), "\n")
+	if desc == "" {
+		desc = group.Name
+	}
+	d = NixDerivation{
+		Name:        group.Name,
+		Version:     PublishVersion(config),
+		Description: desc,
+		Homepage:    config.Packaging.Homepage,
+	}
+	for _, a := range group.Artifacts {
+		var systems []string
+		if system, found := NixSystem(a.Distribution()); found {
+			systems = append(systems, system)
+		} else if a.GOOS == "darwin" && a.GOARCH == UniversalArch {
+			// Universal bundles cover the darwin systems without thin bundles
+			for _, dist := range UniversalDistributions {
+				if _, thin := group.Artifact(dist.GOOS, dist.GOARCH); !thin {
+					system, _ := NixSystem(dist)
+					systems = append(systems, system)
+				}
+			}
+		}
+		if len(systems) == 0 {
+			continue
+		}
+		url, err := group.URL(config, a)
+		if err != nil {
+			return d, false, err
+		}
+		hash, err := SRIHash(a.SHA256)
+		if err != nil {
+			return d, false, err
+		}
+		for _, system := range systems {
+			d.Sources = append(d.Sources, nixSource{System: system, URL: url, Hash: hash})
+		}
+		if d.Binaries == nil {
+			if d.Binaries, err = group.BinaryNames(config, a.Distribution()); err != nil {
+				return d, false, err
+			}
+		}
+	}
+	return d, len(d.Sources) > 0, nil
+}
+
+// Write each derivation and a flake.nix which exposes them as packages for
+// every system they support. The first derivation is the default package and
+// written to default.nix. The others are named after their package so the
+// derivations of every module can share the flake.
+func WriteNix(dir string, derivations []NixDerivation) (err error) {
+	if len(derivations) == 0 {
+		return
+	}
+	derivations = append([]NixDerivation{}, derivations...)
+	files := map[string]bool{}
+	for i := range derivations {
+		derivations[i].File = derivations[i].Name + ".nix"
+		if i == 0 {
+			derivations[i].File = "default.nix"
+		}
+		if files[derivations[i].File] {
+			return fmt.Errorf("multiple Nix derivations are written to %s", derivations[i].File)
+		}
+		files[derivations[i].File] = true
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	var systems []string
+	for _, d := range derivations {
+		if err = writeTemplateFile(filepath.Join(dir, d.File), nixTemplates.Lookup("derivation"), d); err != nil {
+			return
+		}
+		for _, s := range d.Sources {
+			if !StringSliceContains(systems, s.System) {
+				systems = append(systems, s.System)
+			}
+		}
+	}
+	data := map[string]interface{}{"Systems": systems, "Derivations": derivations}
+	if err = writeTemplateFile(filepath.Join(dir, "flake.nix"), nixTemplates.Lookup("flake"), data); err != nil {
+		return fmt.Errorf("failed to write flake.nix: %w", err)
+	}
+	return
+}
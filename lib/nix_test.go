@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNixQuoting(t *testing.T) {
+	cases := map[string]string{
+		"demo":      `"demo"`,
+		`a"b`:       `"a\"b"`,
+		`${x}`:      `"\${x}"`,
+		`back\path`: `"back\\path"`,
+	}
+	for val, want := range cases {
+		if got := nixQuote(val); got != want {
+			t.Errorf("nixQuote(%q) = %s, want %s", val, got, want)
+		}
+	}
+	args := map[string]string{
+		"demo":    "demo",
+		"app-1.0": "app-1.0",
+		"my app":  "'my app'",
+		"${x}":    "'''${x}'",
+		"it's":    `'it'\'''s'`,
+		`a"b`:     `'a"b'`,
+		"a'':b":   `'a'\''''\''':b'`,
+	}
+	for val, want := range args {
+		if got := nixShellArg(val); got != want {
+			t.Errorf("nixShellArg(%q) = %s, want %s", val, got, want)
+		}
+	}
+}
+
+func TestWriteNix(t *testing.T) {
+	dir := t.TempDir()
+	derivations := []NixDerivation{
+		{Name: "alpha", Version: "1.0.0", Binaries: []string{"alpha"}, Sources: []nixSource{{System: "x86_64-linux", URL: "https://e.com/a.zip", Hash: "sha256-a"}}},
+		{Name: "beta", Version: "1.0.0", Binaries: []string{"beta"}, Sources: []nixSource{{System: "aarch64-darwin", URL: "https://e.com/b.zip", Hash: "sha256-b"}}},
+	}
+	if err := WriteNix(dir, derivations); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"default.nix", "beta.nix", "flake.nix"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("missing %s", name)
+		}
+	}
+	flake, _ := os.ReadFile(filepath.Join(dir, "flake.nix"))
+	for _, line := range []string{
+		`"alpha" = pkgs.callPackage ./default.nix { };`,
+		`"beta" = pkgs.callPackage ./beta.nix { };`,
+		`default = pkgs.callPackage ./default.nix { };`,
+		`systems = [ "x86_64-linux" "aarch64-darwin" ];`,
+	} {
+		if !strings.Contains(string(flake), line) {
+			t.Errorf("flake.nix is missing %s", line)
+		}
+	}
+	if derivations[0].File != "" {
+		t.Error("WriteNix modified its arguments")
+	}
+	derivations[1].Name = "default"
+	if err := WriteNix(t.TempDir(), derivations); err == nil {
+		t.Error("expected an error for a second derivation written to default.nix")
+	}
+}
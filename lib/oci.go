@@ -0,0 +1,478 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// Common locations of the CA bundle
+var caBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// Non-root user which matches the distroless images
+const ociPasswd = "root:x:0:0:root:/root:/sbin/nologin\nnonroot:x:65532:65532:nonroot:/home/nonroot:/sbin/nologin\n"
+const ociGroup = "root:x:0:\nnonroot:x:65532:\n"
+
+type Labels map[string]string
+
+// Add a label in the form of key=value
+func (l *Labels) Set(val string) error {
+	key, value, found := StringCut(val, "=")
+	if !found || key == "" {
+		return fmt.Errorf("invalid label %q: expected key=value", val)
+	}
+	if *l == nil {
+		*l = Labels{}
+	}
+	(*l)[key] = value
+	return nil
+}
+
+func (l *Labels) String() string {
+	vals := make([]string, 0, len(*l))
+	for key, val := range *l {
+		vals = append(vals, key+"="+val)
+	}
+	sort.Strings(vals)
+	return strings.Join(vals, ",")
+}
+
+type ImageConfig struct {
+	// Write the image layout as a directory or a tarball. Empty disables images.
+	Layout string
+	// Directory the binaries are copied into
+	BinDir string
+	// Include the CA bundle of the host
+	CACerts bool
+	// Include an /etc/passwd and /etc/group with a nonroot user
+	Passwd bool
+	User   string
+	Files  PackageFiles
+	Labels Labels
+}
+
+const (
+	ImageLayoutDir = "dir"
+	ImageLayoutTar = "tar"
+)
+
+func (c ImageConfig) Validate() error {
+	switch c.Layout {
+	case "", ImageLayoutDir, ImageLayoutTar:
+	default:
+		return fmt.Errorf("unknown image layout %q: must be %s or %s", c.Layout, ImageLayoutDir, ImageLayoutTar)
+	}
+	if c.Layout != "" && !path.IsAbs(c.BinDir) {
+		return fmt.Errorf("image bin dir must be absolute: %s", c.BinDir)
+	}
+	// Names are resolved through /etc/passwd and /etc/group in the image
+	user, group, _ := StringCut(c.User, ":")
+	if !isNumeric(user) && !c.hasFile("/etc/passwd") {
+		return fmt.Errorf("image user %q must be numeric without -oci-passwd or an /etc/passwd file", user)
+	}
+	if group != "" && !isNumeric(group) && !c.hasFile("/etc/group") {
+		return fmt.Errorf("image group %q must be numeric without -oci-passwd or an /etc/group file", group)
+	}
+	return nil
+}
+
+func (c ImageConfig) hasFile(dest string) bool {
+	if c.Passwd {
+		return true
+	}
+	for _, f := range c.Files {
+		if f.Dest == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// An empty user or group is root
+func isNumeric(val string) bool {
+	_, err := strconv.ParseUint(val, 10, 32)
+	return val == "" || err == nil
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int               `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociImageConfig struct {
+	Created      string      `json:"created"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Variant      string      `json:"variant,omitempty"`
+	Config       ociExecSpec `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+type ociExecSpec struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env"`
+	Entrypoint []string          `json:"Entrypoint"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type ociFile struct {
+	Name    string
+	Mode    int64
+	Content []byte
+}
+
+// An OCI image layout with blobs stored by digest
+type ociLayout struct {
+	blobs   map[string][]byte
+	modTime time.Time
+}
+
+func (l *ociLayout) addBlob(mediaType string, data []byte) ociDescriptor {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	l.blobs[digest] = data
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: len(data)}
+}
+
+func (l *ociLayout) addJSON(mediaType string, v interface{}) (desc ociDescriptor, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return l.addBlob(mediaType, data), nil
+}
+
+// Add a gzipped layer and return its descriptor and the digest of the
+// uncompressed tarball
+func (l *ociLayout) addLayer(files []ociFile) (desc ociDescriptor, diffID string, err error) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	raw := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(raw)
+	seen := map[string]bool{}
+	for _, f := range files {
+		var dirs []string
+		for dir := path.Dir(f.Name); dir != "/" && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+			dirs = append([]string{dir}, dirs...)
+		}
+		for _, dir := range dirs {
+			err = writer.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: strings.TrimPrefix(dir, "/") + "/", Mode: 0755, ModTime: l.modTime})
+			if err != nil {
+				return
+			}
+		}
+		err = writer.WriteHeader(&tar.Header{Name: strings.TrimPrefix(f.Name, "/"), Mode: f.Mode, Size: int64(len(f.Content)), ModTime: l.modTime})
+		if err != nil {
+			return
+		}
+		if _, err = writer.Write(f.Content); err != nil {
+			return
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	sum := sha256.Sum256(raw.Bytes())
+	compressed := bytes.NewBuffer(nil)
+	gz, err := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	if err != nil {
+		return
+	}
+	if _, err = gz.Write(raw.Bytes()); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	return l.addBlob(ociLayerType, compressed.Bytes()), "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// The files shared by every platform of the image
+func imageBaseFiles(config BuildConfig) (files []ociFile, env []string, err error) {
+	if config.Image.CACerts {
+		var data []byte
+		for _, loc := range caBundles {
+			if data, err = os.ReadFile(loc); err == nil {
+				break
+			}
+		}
+		if data == nil {
+			return nil, nil, fmt.Errorf("no CA bundle found in %s", strings.Join(caBundles, ", "))
+		}
+		files = append(files, ociFile{Name: "/etc/ssl/certs/ca-certificates.crt", Mode: 0644, Content: data})
+		env = append(env, "SSL_CERT_FILE=/etc/ssl/certs/ca-certificates.crt")
+	}
+	if config.Image.Passwd {
+		files = append(files,
+			ociFile{Name: "/etc/passwd", Mode: 0644, Content: []byte(ociPasswd)},
+			ociFile{Name: "/etc/group", Mode: 0644, Content: []byte(ociGroup)},
+		)
+	}
+	for _, f := range config.Image.Files {
+		data, err := os.ReadFile(f.Src)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, ociFile{Name: f.Dest, Mode: int64(f.Mode), Content: data})
+	}
+	return
+}
+
+// Read the binaries of a bundle
+func readBundleBinaries(config BuildConfig, a Artifact, names []string, binDir string) (files []ociFile, err error) {
+	r, err := zip.OpenReader(filepath.Join(config.OutputDir, filepath.FromSlash(a.Path)))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for _, name := range names {
+		f, err := r.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from %s: %w", name, a.Name, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ociFile{Name: path.Join(binDir, name), Mode: 0755, Content: data})
+	}
+	return
+}
+
+// Build a multi-arch image from the linux bundles of a group. The base files
+// share a layer and the binaries of each platform get their own layer.
+func BuildImage(config BuildConfig, group PublishGroup) (loc string, ok bool, err error) {
+	layout := ociLayout{blobs: map[string][]byte{}, modTime: time.Now().UTC().Truncate(time.Second)}
+	if config.Reproducible {
+		layout.modTime = config.SourceDate.UTC()
+	}
+	baseFiles, env, err := imageBaseFiles(config)
+	if err != nil {
+		return
+	}
+	var baseLayer ociDescriptor
+	var baseDiffID string
+	if len(baseFiles) > 0 {
+		if baseLayer, baseDiffID, err = layout.addLayer(baseFiles); err != nil {
+			return
+		}
+	}
+	labels := map[string]string{
+		"org.opencontainers.image.version": config.Version,
+		"org.opencontainers.image.created": layout.modTime.Format(time.RFC3339),
+	}
+	if config.Packaging.Description != "" {
+		labels["org.opencontainers.image.description"] = strings.TrimSpace(config.Packaging.Description)
+	}
+	for key, val := range config.Image.Labels {
+		labels[key] = val
+	}
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexType, Annotations: labels}
+	for _, a := range group.Artifacts {
+		if a.GOOS != "linux" {
+			continue
+		}
+		names, err := group.BinaryNames(config, a.Distribution())
+		if err != nil {
+			return loc, false, err
+		}
+		files, err := readBundleBinaries(config, a, names, config.Image.BinDir)
+		if err != nil {
+			return loc, false, err
+		}
+		layer, diffID, err := layout.addLayer(files)
+		if err != nil {
+			return loc, false, err
+		}
+		platform := ociPlatform{Architecture: a.GOARCH, OS: a.GOOS}
+		switch a.GOARCH {
+		case "arm":
+			if platform.Variant, err = armVariant(config); err != nil {
+				return loc, false, err
+			}
+		case "arm64":
+			platform.Variant = "v8"
+		}
+		imageConfig := ociImageConfig{
+			Created:      layout.modTime.Format(time.RFC3339),
+			Architecture: platform.Architecture,
+			OS:           platform.OS,
+			Variant:      platform.Variant,
+			Config: ociExecSpec{
+				User:       config.Image.User,
+				Env:        append([]string{"PATH=" + imagePath(config.Image.BinDir)}, env...),
+				Entrypoint: []string{path.Join(config.Image.BinDir, names[0])},
+				Labels:     labels,
+			},
+		}
+		imageConfig.RootFS.Type = "layers"
+		manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestType, Annotations: labels}
+		if baseDiffID != "" {
+			imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, baseDiffID)
+			manifest.Layers = append(manifest.Layers, baseLayer)
+		}
+		imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, diffID)
+		manifest.Layers = append(manifest.Layers, layer)
+		if manifest.Config, err = layout.addJSON(ociConfigType, imageConfig); err != nil {
+			return loc, false, err
+		}
+		desc, err := layout.addJSON(ociManifestType, manifest)
+		if err != nil {
+			return loc, false, err
+		}
+		desc.Platform = &platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+	if len(index.Manifests) == 0 {
+		return
+	}
+	indexDesc, err := layout.addJSON(ociIndexType, index)
+	if err != nil {
+		return
+	}
+	indexDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": strings.ReplaceAll(config.Version, "+", "_")}
+	top, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexType, Manifests: []ociDescriptor{indexDesc}})
+	if err != nil {
+		return
+	}
+	files := map[string][]byte{
+		"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		"index.json": top,
+	}
+	for digest, data := range layout.blobs {
+		files["blobs/sha256/"+strings.TrimPrefix(digest, "sha256:")] = data
+	}
+	loc = filepath.Join(config.OutputDir, group.Name+".oci")
+	if config.Image.Layout == ImageLayoutTar {
+		loc += ".tar"
+		return loc, true, writeLayoutTar(loc, files, layout.modTime)
+	}
+	return loc, true, writeLayoutDir(loc, files)
+}
+
+// The default PATH with the bin dir first
+func imagePath(binDir string) string {
+	dirs := []string{binDir}
+	for _, dir := range []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"} {
+		if dir != binDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return strings.Join(dirs, ":")
+}
+
+func writeLayoutDir(dir string, files map[string][]byte) (err error) {
+	if err = os.RemoveAll(dir); err != nil {
+		return
+	}
+	for name, data := range files {
+		loc := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(loc), 0755); err != nil {
+			return
+		}
+		if err = os.WriteFile(loc, data, 0644); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeLayoutTar(loc string, files map[string][]byte, modTime time.Time) (err error) {
+	outf, err := os.Create(loc)
+	if err != nil {
+		return
+	}
+	if err = writeTarFiles(outf, files, modTime); err != nil {
+		outf.Close()
+		return
+	}
+	return outf.Close()
+}
+
+func writeTarFiles(w io.Writer, files map[string][]byte, modTime time.Time) (err error) {
+	writer := tar.NewWriter(w)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: modTime})
+		if err != nil {
+			return
+		}
+		if _, err = writer.Write(files[name]); err != nil {
+			return
+		}
+	}
+	return writer.Close()
+}
+
+// The platform variant of the linux/arm binaries from the GOARM they were
+// built with. GOARM may have a float mode suffix like 6,softfloat.
+func armVariant(config BuildConfig) (variant string, err error) {
+	cmd := GoCommand(config, "env", "GOARM")
+	cmd.Env = append(cmd.Env, "GOOS=linux", "GOARCH=arm")
+	out, err := commandOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to get GOARM: %w", err)
+	}
+	goarm, _, _ := StringCut(strings.TrimSpace(out), ",")
+	if goarm == "" {
+		goarm = "7"
+	}
+	return "v" + goarm, nil
+}
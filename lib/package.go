@@ -0,0 +1,320 @@
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PackageDeb       = "deb"
+	PackageRPM       = "rpm"
+	PackageAPK       = "apk"
+	PackageArchLinux = "archlinux"
+)
+
+type packageFormat struct {
+	// Map GOARCH to the architecture name of the format
+	arch  func(goarch string) (string, bool)
+	name  func(p Package, arch string) string
+	write func(finalPath string, p Package, arch string) error
+}
+
+var packageFormats = map[string]packageFormat{
+	PackageDeb:       {arch: DebianArch, name: DebName, write: WriteDeb},
+	PackageRPM:       {arch: RPMArch, name: RPMName, write: WriteRPM},
+	PackageAPK:       {arch: APKArch, name: APKName, write: WriteAPK},
+	PackageArchLinux: {arch: ArchLinuxArch, name: ArchLinuxName, write: WriteArchLinux},
+}
+
+// The names of the supported package formats
+func PackageFormats() (res []string) {
+	for name := range packageFormats {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return
+}
+
+type PackageFile struct {
+	// Location of the file on disk
+	Src string
+	// Absolute install path
+	Dest string
+	Mode os.FileMode
+}
+
+type PackageFiles []PackageFile
+
+// Parse a file in the form of src:dest[:mode] where mode is octal
+func (f *PackageFiles) Set(val string) error {
+	parts := strings.Split(val, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !path.IsAbs(parts[1]) {
+		return fmt.Errorf("invalid package file %q: expected src:/dest[:mode]", val)
+	}
+	file := PackageFile{Src: parts[0], Dest: path.Clean(parts[1]), Mode: 0644}
+	if len(parts) == 3 {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid package file %q: mode must be octal", val)
+		}
+		file.Mode = os.FileMode(mode)
+	}
+	*f = append(*f, file)
+	return nil
+}
+
+func (f *PackageFiles) String() string {
+	vals := make([]string, len(*f))
+	for i, file := range *f {
+		vals[i] = fmt.Sprintf("%s:%s:%o", file.Src, file.Dest, file.Mode)
+	}
+	return strings.Join(vals, ",")
+}
+
+// Metadata shared by every package format
+type PackageConfig struct {
+	Formats StringSlice
+	// Package name. Defaults to the name of the bundle.
+	Name        string
+	Release     string
+	Maintainer  string
+	Description string
+	Homepage    string
+	License     string
+	Depends     StringSlice
+	// Directory the binaries are installed into
+	BinDir string
+	Files  PackageFiles
+	// Paths to the maintainer scripts
+	PreInstall  string
+	PostInstall string
+	PreRemove   string
+	PostRemove  string
+}
+
+func (c PackageConfig) Validate() error {
+	for _, format := range c.Formats {
+		if _, ok := packageFormats[format]; !ok {
+			return fmt.Errorf("unknown package format %q: must be one of %s", format, strings.Join(PackageFormats(), ", "))
+		}
+	}
+	if len(c.Formats) > 0 && !path.IsAbs(c.BinDir) {
+		return fmt.Errorf("package bin dir must be absolute: %s", c.BinDir)
+	}
+	return nil
+}
+
+// The files read while packaging. Their contents change the packages.
+func (c PackageConfig) Inputs() (res []string) {
+	for _, f := range c.Files {
+		res = append(res, f.Src)
+	}
+	for _, loc := range []string{c.PreInstall, c.PostInstall, c.PreRemove, c.PostRemove} {
+		if loc != "" {
+			res = append(res, loc)
+		}
+	}
+	return
+}
+
+// Check if a distribution should be packaged
+func (c PackageConfig) Has(dist Distribution) bool {
+	return dist.GOOS == "linux" && len(c.Formats) > 0
+}
+
+// A single package for a distribution
+type Package struct {
+	Name    string
+	Version string
+	Release string
+	Config  PackageConfig
+	Files   []PackageFile
+	ModTime time.Time
+}
+
+// Create the package for a bundle group. Binaries are installed into the bin
+// dir using their name.
+func NewPackage(config BuildConfig, bundleBin Binary, group Binaries, binDir string) (p Package) {
+	p = Package{
+		Name:    PackageName(config, bundleBin),
+		Version: PackageVersion(config.Version),
+		Release: config.Packaging.Release,
+		Config:  config.Packaging,
+		ModTime: time.Now().Truncate(time.Second),
+	}
+	if p.Release == "" {
+		p.Release = "1"
+	}
+	if config.Reproducible {
+		p.ModTime = config.SourceDate
+	}
+	for _, bin := range group {
+		p.Files = append(p.Files, PackageFile{
+			Src:  filepath.Join(binDir, bin.Name),
+			Dest: path.Join(config.Packaging.BinDir, bin.Name),
+			Mode: 0755,
+		})
+	}
+	p.Files = append(p.Files, config.Packaging.Files...)
+	sort.Slice(p.Files, func(i, j int) bool { return p.Files[i].Dest < p.Files[j].Dest })
+	return
+}
+
+// The package name of a bundle group. Separate bundles are always named after
+// their binary.
+func PackageName(config BuildConfig, bundleBin Binary) string {
+	if config.Packaging.Name == "" || config.SeparateBundles {
+		return bundleBin.Name
+	}
+	return config.Packaging.Name
+}
+
+// The parent directories of every file in the package excluding the root
+func (p Package) Dirs() (res []string) {
+	seen := map[string]bool{}
+	for _, f := range p.Files {
+		for dir := path.Dir(f.Dest); dir != "/" && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+			res = append(res, dir)
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+// The maintainer scripts by their name in the package config
+func (p Package) Scripts() (res map[string]string, err error) {
+	res = map[string]string{}
+	paths := map[string]string{
+		"preinstall":  p.Config.PreInstall,
+		"postinstall": p.Config.PostInstall,
+		"preremove":   p.Config.PreRemove,
+		"postremove":  p.Config.PostRemove,
+	}
+	for name, loc := range paths {
+		if loc == "" {
+			continue
+		}
+		data, err := os.ReadFile(loc)
+		if err != nil {
+			return res, fmt.Errorf("failed to read %s script: %w", name, err)
+		}
+		res[name] = string(data)
+	}
+	return
+}
+
+// Convert a version like v1.2.3 or v1.2.3-4-gabcdef into a package version
+// which starts with a number and doesn't contain a hyphen
+func PackageVersion(version string) string {
+	version = strings.TrimPrefix(version, "v")
+	version = strings.ReplaceAll(version, "-", "+")
+	if version == "" || version[0] < '0' || version[0] > '9' {
+		version = "0.0.0+" + version
+	}
+	return strings.TrimSuffix(version, "+")
+}
+
+// Write a package in the output directory. Returns false when the format has
+// no architecture for the distribution.
+func WritePackage(config BuildConfig, format string, p Package, dist Distribution) (finalPath string, ok bool, err error) {
+	f := packageFormats[format]
+	arch, ok := f.arch(dist.GOARCH)
+	if !ok {
+		return
+	}
+	finalPath = filepath.Join(config.OutputDir, f.name(p, arch))
+	return finalPath, true, f.write(finalPath, p, arch)
+}
+
+// A metadata file inside of a package
+type controlFile struct {
+	name    string
+	content string
+	mode    int64
+}
+
+// Split a dependency like "name", "name >= 1.0", "name (>= 1.0)" or
+// "name>=1.0" into its name, operator and version
+func SplitDependency(dep string) (name, op, version string) {
+	dep = strings.NewReplacer("(", " ", ")", " ").Replace(dep)
+	i := strings.IndexAny(dep, "<>=")
+	if i < 0 {
+		return strings.TrimSpace(dep), "", ""
+	}
+	name = strings.TrimSpace(dep[:i])
+	rest := dep[i:]
+	j := strings.IndexFunc(rest, func(r rune) bool { return !strings.ContainsRune("<>=", r) })
+	if j < 0 {
+		return name, "", ""
+	}
+	return name, rest[:j], strings.TrimSpace(rest[j:])
+}
+
+// Format a dependency like "name >= 1.0" as "name>=1.0"
+func compactDependency(dep string) string {
+	name, op, version := SplitDependency(dep)
+	return name + op + version
+}
+
+// Write the directories and files of a package to a tarball with each name
+// prefixed by prefix. The header of each file can be changed by the edit
+// func before it's written.
+func writePackageFiles(writer *tar.Writer, p Package, prefix string, edit func(hdr *tar.Header, content []byte)) (err error) {
+	for _, dir := range p.Dirs() {
+		err = writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     prefix + strings.TrimPrefix(dir, "/") + "/",
+			Mode:     0755,
+			ModTime:  p.ModTime,
+			Uname:    "root",
+			Gname:    "root",
+		})
+		if err != nil {
+			return
+		}
+	}
+	for _, f := range p.Files {
+		content, err := os.ReadFile(f.Src)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    prefix + strings.TrimPrefix(f.Dest, "/"),
+			Mode:    int64(f.Mode),
+			Size:    int64(len(content)),
+			ModTime: p.ModTime,
+			Uname:   "root",
+			Gname:   "root",
+		}
+		if edit != nil {
+			edit(hdr, content)
+		}
+		if err = writer.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = writer.Write(content); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// The installed size of the package in bytes
+func (p Package) Size() (size int64, err error) {
+	for _, f := range p.Files {
+		info, err := os.Stat(f.Src)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPackageFilesSet(t *testing.T) {
+	cases := []struct {
+		val     string
+		want    PackageFile
+		wantErr bool
+	}{
+		{val: "conf.yml:/etc/app/conf.yml", want: PackageFile{Src: "conf.yml", Dest: "/etc/app/conf.yml", Mode: 0644}},
+		{val: "run.sh:/usr/lib/app/run.sh:755", want: PackageFile{Src: "run.sh", Dest: "/usr/lib/app/run.sh", Mode: 0755}},
+		{val: "a:/usr/share//app/../a", want: PackageFile{Src: "a", Dest: "/usr/share/a", Mode: 0644}},
+		{val: "conf.yml", wantErr: true},
+		{val: ":/etc/conf.yml", wantErr: true},
+		{val: "conf.yml:etc/conf.yml", wantErr: true},
+		{val: "run.sh:/usr/bin/run:rwx", wantErr: true},
+		{val: "run.sh:/usr/bin/run:755:x", wantErr: true},
+	}
+	for _, c := range cases {
+		var files PackageFiles
+		err := files.Set(c.val)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) expected an error", c.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) failed: %s", c.val, err)
+			continue
+		}
+		if len(files) != 1 || files[0] != c.want {
+			t.Errorf("Set(%q) = %+v, want %+v", c.val, files, c.want)
+		}
+	}
+}
+
+func TestPackageVersion(t *testing.T) {
+	cases := map[string]string{
+		"v1.2.3":              "1.2.3",
+		"1.2.3":               "1.2.3",
+		"v1.2.3-4-gabcdef":    "1.2.3+4+gabcdef",
+		"v1.2.3-4-gabcdef-10": "1.2.3+4+gabcdef+10",
+		"abcdef":              "0.0.0+abcdef",
+		"":                    "0.0.0",
+	}
+	for version, want := range cases {
+		if got := PackageVersion(version); got != want {
+			t.Errorf("PackageVersion(%q) = %q, want %q", version, got, want)
+		}
+	}
+}
+
+func TestPackageDirs(t *testing.T) {
+	p := Package{Files: []PackageFile{
+		{Dest: "/usr/bin/app"},
+		{Dest: "/etc/app/conf.yml"},
+		{Dest: "/usr/share/app/data/a.txt"},
+	}}
+	want := []string{"/etc", "/etc/app", "/usr", "/usr/bin", "/usr/share", "/usr/share/app", "/usr/share/app/data"}
+	if got := p.Dirs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dirs() = %q, want %q", got, want)
+	}
+}
+
+// A package with a binary, a config file and a postinstall script
+func testPackage(t *testing.T) Package {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app":         "#!/bin/sh\necho app\n",
+		"conf.yml":    "key: value\n",
+		"postinstall": "#!/bin/sh\necho installed\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Package{
+		Name:    "app",
+		Version: "1.2.3",
+		Release: "1",
+		Config: PackageConfig{
+			Maintainer:  "Jane Doe <jane@example.com>",
+			Description: "An app\nIt does things.\n\nReally.",
+			Homepage:    "https://example.com",
+			License:     "MIT",
+			Depends:     StringSlice{"libc6 >= 2.31", "ca-certificates"},
+			PostInstall: filepath.Join(dir, "postinstall"),
+		},
+		Files: []PackageFile{
+			{Src: filepath.Join(dir, "conf.yml"), Dest: "/etc/app/conf.yml", Mode: 0644},
+			{Src: filepath.Join(dir, "app"), Dest: "/usr/bin/app", Mode: 0755},
+		},
+		ModTime: time.Unix(1700000000, 0),
+	}
+}
+
+func TestSplitDependency(t *testing.T) {
+	cases := []struct {
+		dep, name, op, version string
+	}{
+		{"bash", "bash", "", ""},
+		{" bash ", "bash", "", ""},
+		{"bash >= 5.1", "bash", ">=", "5.1"},
+		{"bash (>= 5.1)", "bash", ">=", "5.1"},
+		{"bash>=5.1", "bash", ">=", "5.1"},
+		{"bash<5", "bash", "<", "5"},
+		{"bash >> 5", "bash", ">>", "5"},
+		{"bash = 5.1-r2", "bash", "=", "5.1-r2"},
+		{"bash >=", "bash", "", ""},
+	}
+	for _, c := range cases {
+		name, op, version := SplitDependency(c.dep)
+		if name != c.name || op != c.op || version != c.version {
+			t.Errorf("SplitDependency(%q) = %q, %q, %q, want %q, %q, %q", c.dep, name, op, version, c.name, c.op, c.version)
+		}
+	}
+}
+
+func TestCompactDependency(t *testing.T) {
+	cases := map[string]string{
+		"musl":          "musl",
+		"musl >= 1.2":   "musl>=1.2",
+		"musl (< 1.3)":  "musl<1.3",
+		"glibc = 2.38 ": "glibc=2.38",
+	}
+	for dep, want := range cases {
+		if got := compactDependency(dep); got != want {
+			t.Errorf("compactDependency(%q) = %q, want %q", dep, got, want)
+		}
+	}
+}
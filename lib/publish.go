@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"strings"
+	"text/template"
+)
+
+// Settings for the package manager manifests generated from the artifacts
+type PublishConfig struct {
+	// Template for the download URL of an artifact. It has the same values as
+	// the bundle template plus the artifact file name as {{.ARTIFACT}}.
+	URLTemplate string
+	// Homebrew tap directory to write formulas to
+	HomebrewTap string
+	// Ruby code for the test block of the formula
+	HomebrewTest string
+	// Scoop bucket directory to write manifests to
+	ScoopBucket string
+	// Directory to write winget manifests to and the package identifier
+	WingetDir string
+	WingetID  string
+	// Directory to write the Nix derivations and flake to
+	NixDir string
+}
+
+// Check if any manifests should be generated
+func (c PublishConfig) Enabled() bool {
+	return c.HomebrewTap != "" || c.ScoopBucket != "" || c.WingetDir != "" || c.NixDir != ""
+}
+
+// The bundles of a single bundle group which are published together
+type PublishGroup struct {
+	// Name of the package
+	Name string
+	// Binary used to render the bundle name
+	Bundle    Binary
+	Binaries  Binaries
+	Artifacts []Artifact
+}
+
+// The distribution an artifact was built for
+func (a Artifact) Distribution() Distribution {
+	return Distribution{GOOS: a.GOOS, GOARCH: a.GOARCH}
+}
+
+// Group the bundles built with the current toolchain by bundle group
+func PublishGroups(config BuildConfig, artifacts []Artifact) (res []PublishGroup) {
+	for _, group := range BundleGroups(config) {
+		bundleBin := BundleBinary(config, group)
+		pg := PublishGroup{Name: PackageName(config, bundleBin), Bundle: bundleBin, Binaries: group}
+		names := make([]string, len(group))
+		for i, bin := range group {
+			names[i] = bin.Name
+		}
+		for _, a := range artifacts {
+			if a.Kind != ArtifactBundle || a.GoVersion != config.Toolchain.Version {
+				continue
+			}
+			if strings.Join(a.Binaries, ",") == strings.Join(names, ",") {
+				pg.Artifacts = append(pg.Artifacts, a)
+			}
+		}
+		res = append(res, pg)
+	}
+	return
+}
+
+// Find the artifact for a distribution
+func (g PublishGroup) Artifact(goos, goarch string) (a Artifact, ok bool) {
+	for _, a := range g.Artifacts {
+		if a.GOOS == goos && a.GOARCH == goarch {
+			return a, true
+		}
+	}
+	return
+}
+
+// The names of the binaries inside of the bundles for a distribution
+func (g PublishGroup) BinaryNames(config BuildConfig, dist Distribution) (res []string, err error) {
+	for _, bin := range g.Binaries {
+		name, err := RenderName(config, dist, bin)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, name)
+	}
+	return
+}
+
+// Render the download URL of an artifact in the group
+func (g PublishGroup) URL(config BuildConfig, a Artifact) (string, error) {
+	tmpl, err := template.New("url").Parse(config.Publish.URLTemplate)
+	if err != nil {
+		return "", err
+	}
+	data := TemplateData(config, a.Distribution(), g.Bundle)
+	data["ARTIFACT"] = a.Name
+	return RenderString(tmpl, data)
+}
+
+// The version without a leading v
+func PublishVersion(config BuildConfig) string {
+	return strings.TrimPrefix(config.Version, "v")
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Linker flag which removes the build ID
+const ReproducibleLdFlags = "-buildid="
+
+// Add the go build flags needed for reproducible builds unless they are
+// already present
+func ReproducibleArgs(args []string) (res []string) {
+	res = append(res, args...)
+	for _, flag := range []string{"-trimpath", "-buildvcs=false"} {
+		name, _, _ := StringCut(flag, "=")
+		if !hasFlag(res, name) {
+			res = append(res, flag)
+		}
+	}
+	return
+}
+
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		arg, _, _ = StringCut(arg, "=")
+		if arg == name || arg == "-"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine the timestamp to use for bundle entries. SOURCE_DATE_EPOCH is used
+// when set, then the time of the last commit and finally the unix epoch.
+func SourceDateEpoch(dir string) (t time.Time, err error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		buf := bytes.NewBuffer(nil)
+		cmd := exec.CommandContext(context.Background(), "git", "log", "-1", "--format=%ct")
+		cmd.Dir = dir
+		cmd.Stdout = buf
+		if cmd.Run() == nil {
+			epoch = strings.TrimSpace(buf.String())
+		}
+	}
+	if epoch == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return t, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+func HashFile(loc string) (string, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,474 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var rpmArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "armv7hl",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// Map GOARCH to the RPM architecture name
+func RPMArch(goarch string) (arch string, ok bool) {
+	arch, ok = rpmArchs[goarch]
+	return
+}
+
+// The file name of an RPM package like name-1.2.3-1.x86_64.rpm
+func RPMName(p Package, arch string) string {
+	return fmt.Sprintf("%s-%s-%s.%s.rpm", p.Name, p.Version, p.Release, arch)
+}
+
+// Header entry types
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// Header tags
+const (
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagI18NTable        = 100
+	rpmTagName             = 1000
+	rpmTagVersion          = 1001
+	rpmTagRelease          = 1002
+	rpmTagSummary          = 1004
+	rpmTagDescription      = 1005
+	rpmTagBuildTime        = 1006
+	rpmTagBuildHost        = 1007
+	rpmTagSize             = 1009
+	rpmTagLicense          = 1014
+	rpmTagPackager         = 1015
+	rpmTagGroup            = 1016
+	rpmTagURL              = 1020
+	rpmTagOS               = 1021
+	rpmTagArch             = 1022
+	rpmTagPreIn            = 1023
+	rpmTagPostIn           = 1024
+	rpmTagPreUn            = 1025
+	rpmTagPostUn           = 1026
+	rpmTagFileSizes        = 1028
+	rpmTagFileModes        = 1030
+	rpmTagFileRdevs        = 1033
+	rpmTagFileMTimes       = 1034
+	rpmTagFileDigests      = 1035
+	rpmTagFileLinkTos      = 1036
+	rpmTagFileFlags        = 1037
+	rpmTagFileUserName     = 1039
+	rpmTagFileGroupName    = 1040
+	rpmTagSourceRPM        = 1044
+	rpmTagProvideName      = 1047
+	rpmTagRequireFlags     = 1048
+	rpmTagRequireName      = 1049
+	rpmTagRequireVersion   = 1050
+	rpmTagPreInProg        = 1085
+	rpmTagPostInProg       = 1086
+	rpmTagPreUnProg        = 1087
+	rpmTagPostUnProg       = 1088
+	rpmTagFileDevices      = 1095
+	rpmTagFileInodes       = 1096
+	rpmTagFileLangs        = 1097
+	rpmTagProvideFlags     = 1112
+	rpmTagProvideVersion   = 1113
+	rpmTagDirIndexes       = 1116
+	rpmTagBaseNames        = 1117
+	rpmTagDirNames         = 1118
+	rpmTagPayloadFormat    = 1124
+	rpmTagPayloadCompr     = 1125
+	rpmTagPayloadFlags     = 1126
+	rpmTagFileDigestAlgo   = 5011
+)
+
+// Signature tags
+const (
+	rpmSigSHA1        = 269
+	rpmSigSHA256      = 273
+	rpmSigSize        = 1000
+	rpmSigMD5         = 1004
+	rpmSigPayloadSize = 1007
+)
+
+// Dependency flags
+const (
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+	rpmSenseRPMLib  = 1 << 24
+)
+
+// File flags for config files which aren't replaced on upgrade
+const rpmFileConfigNoReplace = 1<<0 | 1<<4
+
+type rpmEntry struct {
+	tag   int32
+	typ   int32
+	count int32
+	data  []byte
+}
+
+// An RPM header made of index entries and a data store
+type rpmHeader struct {
+	region  int32
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) add(tag, typ int32, count int, data []byte) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: typ, count: int32(count), data: data})
+}
+
+func (h *rpmHeader) addString(tag int32, val string) {
+	h.add(tag, rpmString, 1, append([]byte(val), 0))
+}
+
+func (h *rpmHeader) addI18NString(tag int32, val string) {
+	h.add(tag, rpmI18NString, 1, append([]byte(val), 0))
+}
+
+func (h *rpmHeader) addStrings(tag int32, vals []string) {
+	buf := bytes.NewBuffer(nil)
+	for _, val := range vals {
+		buf.WriteString(val)
+		buf.WriteByte(0)
+	}
+	h.add(tag, rpmStringArray, len(vals), buf.Bytes())
+}
+
+func (h *rpmHeader) addInt32(tag int32, vals ...int32) {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, vals)
+	h.add(tag, rpmInt32, len(vals), buf.Bytes())
+}
+
+func (h *rpmHeader) addInt16(tag int32, vals ...int16) {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, vals)
+	h.add(tag, rpmInt16, len(vals), buf.Bytes())
+}
+
+func (h *rpmHeader) addBin(tag int32, data []byte) {
+	h.add(tag, rpmBin, len(data), data)
+}
+
+// Serialize the header. The region entry comes first in the index and its
+// trailer, which points back at the start of the index, last in the data.
+func (h rpmHeader) bytes() []byte {
+	entries := append([]rpmEntry{}, h.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	count := len(entries) + 1
+	store := bytes.NewBuffer(nil)
+	index := bytes.NewBuffer(nil)
+	for _, e := range entries {
+		align := 1
+		switch e.typ {
+		case rpmInt16:
+			align = 2
+		case rpmInt32:
+			align = 4
+		}
+		for store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		binary.Write(index, binary.BigEndian, []int32{e.tag, e.typ, int32(store.Len()), e.count})
+		store.Write(e.data)
+	}
+	trailerOffset := store.Len()
+	binary.Write(store, binary.BigEndian, []int32{h.region, rpmBin, int32(-16 * count), 16})
+
+	res := bytes.NewBuffer(nil)
+	res.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(res, binary.BigEndian, []int32{int32(count), int32(store.Len())})
+	binary.Write(res, binary.BigEndian, []int32{h.region, rpmBin, int32(trailerOffset), 16})
+	res.Write(index.Bytes())
+	res.Write(store.Bytes())
+	return res.Bytes()
+}
+
+// Convert a dependency into its name, flags and version
+func rpmDependency(dep string) (name string, flags int32, version string) {
+	name, op, version := SplitDependency(dep)
+	for _, c := range op {
+		switch c {
+		case '<':
+			flags |= rpmSenseLess
+		case '>':
+			flags |= rpmSenseGreater
+		case '=':
+			flags |= rpmSenseEqual
+		}
+	}
+	return
+}
+
+// Write an RPM package. The package is the lead, the signature header, the
+// main header and a gzipped cpio payload.
+func WriteRPM(finalPath string, p Package, arch string) (err error) {
+	h := rpmHeader{region: rpmTagHeaderImmutable}
+	payload, payloadSize, err := rpmPayload(p, &h)
+	if err != nil {
+		return
+	}
+	scripts, err := p.Scripts()
+	if err != nil {
+		return
+	}
+	summary, description, _ := StringCut(strings.TrimSpace(p.Config.Description), "\n")
+	if summary == "" {
+		summary = p.Name
+	}
+	description = strings.TrimSpace(description)
+	if description == "" {
+		description = summary
+	}
+	license := p.Config.License
+	if license == "" {
+		license = "Unknown"
+	}
+	h.addStrings(rpmTagI18NTable, []string{"C"})
+	h.addString(rpmTagName, p.Name)
+	h.addString(rpmTagVersion, p.Version)
+	h.addString(rpmTagRelease, p.Release)
+	h.addI18NString(rpmTagSummary, summary)
+	h.addI18NString(rpmTagDescription, description)
+	h.addInt32(rpmTagBuildTime, int32(p.ModTime.Unix()))
+	h.addString(rpmTagBuildHost, "gbuild")
+	h.addString(rpmTagLicense, license)
+	h.addI18NString(rpmTagGroup, "Unspecified")
+	h.addString(rpmTagOS, "linux")
+	h.addString(rpmTagArch, arch)
+	h.addString(rpmTagSourceRPM, fmt.Sprintf("%s-%s-%s.src.rpm", p.Name, p.Version, p.Release))
+	h.addString(rpmTagPayloadFormat, "cpio")
+	h.addString(rpmTagPayloadCompr, "gzip")
+	h.addString(rpmTagPayloadFlags, "9")
+	if p.Config.Maintainer != "" {
+		h.addString(rpmTagPackager, p.Config.Maintainer)
+	}
+	if p.Config.Homepage != "" {
+		h.addString(rpmTagURL, p.Config.Homepage)
+	}
+	for _, s := range []struct {
+		tag, progTag int32
+		name         string
+	}{
+		{rpmTagPreIn, rpmTagPreInProg, "preinstall"},
+		{rpmTagPostIn, rpmTagPostInProg, "postinstall"},
+		{rpmTagPreUn, rpmTagPreUnProg, "preremove"},
+		{rpmTagPostUn, rpmTagPostUnProg, "postremove"},
+	} {
+		if script, ok := scripts[s.name]; ok {
+			h.addString(s.tag, script)
+			h.addString(s.progTag, "/bin/sh")
+		}
+	}
+	version := p.Version + "-" + p.Release
+	h.addStrings(rpmTagProvideName, []string{p.Name})
+	h.addInt32(rpmTagProvideFlags, rpmSenseEqual)
+	h.addStrings(rpmTagProvideVersion, []string{version})
+	// Features of rpm the package relies on
+	requireNames := []string{"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)"}
+	requireVersions := []string{"3.0.4-1", "4.6.0-1", "4.0-1"}
+	requireFlags := []int32{rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib}
+	for _, dep := range p.Config.Depends {
+		name, flags, version := rpmDependency(dep)
+		if name == "" {
+			continue
+		}
+		requireNames = append(requireNames, name)
+		requireFlags = append(requireFlags, flags)
+		requireVersions = append(requireVersions, version)
+	}
+	h.addStrings(rpmTagRequireName, requireNames)
+	h.addInt32(rpmTagRequireFlags, requireFlags...)
+	h.addStrings(rpmTagRequireVersion, requireVersions)
+	header := h.bytes()
+
+	headerSHA1 := sha1.Sum(header)
+	headerSHA256 := sha256.Sum256(header)
+	digest := md5.New()
+	digest.Write(header)
+	digest.Write(payload)
+	sig := rpmHeader{region: rpmTagHeaderSignatures}
+	sig.addString(rpmSigSHA1, hex.EncodeToString(headerSHA1[:]))
+	sig.addString(rpmSigSHA256, hex.EncodeToString(headerSHA256[:]))
+	sig.addInt32(rpmSigSize, int32(len(header)+len(payload)))
+	sig.addBin(rpmSigMD5, digest.Sum(nil))
+	sig.addInt32(rpmSigPayloadSize, int32(payloadSize))
+	sigBytes := sig.bytes()
+	// The signature is padded to a multiple of 8 bytes
+	for len(sigBytes)%8 != 0 {
+		sigBytes = append(sigBytes, 0)
+	}
+
+	outf, err := os.Create(finalPath)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	for _, data := range [][]byte{rpmLead(p), sigBytes, header, payload} {
+		if _, err = outf.Write(data); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func rpmLead(p Package) []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	// Binary package type, architecture number and the name
+	binary.BigEndian.PutUint16(lead[6:], 0)
+	binary.BigEndian.PutUint16(lead[8:], 1)
+	name := fmt.Sprintf("%s-%s-%s", p.Name, p.Version, p.Release)
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:76], name)
+	// Linux and the header style signature
+	binary.BigEndian.PutUint16(lead[76:], 1)
+	binary.BigEndian.PutUint16(lead[78:], 5)
+	return lead
+}
+
+// Create the gzipped cpio payload and add the file list to the header.
+// Directories aren't owned by the package.
+func rpmPayload(p Package, h *rpmHeader) (payload []byte, size int, err error) {
+	var (
+		sizes, mtimes, flags, devices, inodes, dirIndexes []int32
+		modes, rdevs                                      []int16
+		digests, linkTos, users, groups, langs, basenames []string
+		dirs                                              []string
+		total                                             int32
+	)
+	dirIndex := map[string]int32{}
+	buf := bytes.NewBuffer(nil)
+	gz, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return
+	}
+	counter := &countWriter{w: gz}
+	for i, f := range p.Files {
+		content, err := os.ReadFile(f.Src)
+		if err != nil {
+			return nil, 0, err
+		}
+		mode := 0100000 | uint32(f.Mode.Perm())
+		if err = writeCpioEntry(counter, i+1, "."+f.Dest, mode, p.ModTime.Unix(), content); err != nil {
+			return nil, 0, err
+		}
+		dir := path.Dir(f.Dest) + "/"
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = int32(len(dirs))
+			dirs = append(dirs, dir)
+		}
+		sum := sha256.Sum256(content)
+		fileFlags := int32(0)
+		if strings.HasPrefix(f.Dest, "/etc/") {
+			fileFlags = rpmFileConfigNoReplace
+		}
+		sizes = append(sizes, int32(len(content)))
+		mtimes = append(mtimes, int32(p.ModTime.Unix()))
+		flags = append(flags, fileFlags)
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(i+1))
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		modes = append(modes, int16(mode))
+		rdevs = append(rdevs, 0)
+		digests = append(digests, hex.EncodeToString(sum[:]))
+		linkTos = append(linkTos, "")
+		users = append(users, "root")
+		groups = append(groups, "root")
+		langs = append(langs, "")
+		basenames = append(basenames, path.Base(f.Dest))
+		total += int32(len(content))
+	}
+	if err = writeCpioEntry(counter, 0, "TRAILER!!!", 0, 0, nil); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	h.addInt32(rpmTagSize, total)
+	if len(p.Files) > 0 {
+		h.addInt32(rpmTagFileSizes, sizes...)
+		h.addInt16(rpmTagFileModes, modes...)
+		h.addInt16(rpmTagFileRdevs, rdevs...)
+		h.addInt32(rpmTagFileMTimes, mtimes...)
+		h.addStrings(rpmTagFileDigests, digests)
+		h.addStrings(rpmTagFileLinkTos, linkTos)
+		h.addInt32(rpmTagFileFlags, flags...)
+		h.addStrings(rpmTagFileUserName, users)
+		h.addStrings(rpmTagFileGroupName, groups)
+		h.addInt32(rpmTagFileDevices, devices...)
+		h.addInt32(rpmTagFileInodes, inodes...)
+		h.addStrings(rpmTagFileLangs, langs)
+		h.addInt32(rpmTagDirIndexes, dirIndexes...)
+		h.addStrings(rpmTagBaseNames, basenames)
+		h.addStrings(rpmTagDirNames, dirs)
+		// SHA-256
+		h.addInt32(rpmTagFileDigestAlgo, 8)
+	}
+	return buf.Bytes(), counter.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += n
+	return
+}
+
+// Write a file in the cpio newc format
+func writeCpioEntry(w *countWriter, inode int, name string, mode uint32, mtime int64, content []byte) (err error) {
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		inode, mode, 0, 0, 1, mtime, len(content), 0, 0, 0, 0, len(name)+1, 0)
+	if _, err = io.WriteString(w, header+name+"\x00"); err != nil {
+		return
+	}
+	if err = cpioPad(w); err != nil {
+		return
+	}
+	if _, err = w.Write(content); err != nil {
+		return
+	}
+	return cpioPad(w)
+}
+
+// Pad to a multiple of 4 bytes
+func cpioPad(w *countWriter) (err error) {
+	if w.n%4 != 0 {
+		_, err = w.Write(make([]byte, 4-w.n%4))
+	}
+	return
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A header entry read back from an RPM with its data starting at its offset
+type parsedRPMEntry struct {
+	typ, count int32
+	data       []byte
+}
+
+type parsedRPMHeader map[int32]parsedRPMEntry
+
+func (h parsedRPMHeader) strings(t *testing.T, tag int32) []string {
+	t.Helper()
+	e, ok := h[tag]
+	if !ok {
+		t.Fatalf("missing tag %d", tag)
+	}
+	if e.typ != rpmString && e.typ != rpmStringArray && e.typ != rpmI18NString {
+		t.Fatalf("tag %d has type %d instead of a string", tag, e.typ)
+	}
+	return strings.Split(string(e.data), "\x00")[:e.count]
+}
+
+func (h parsedRPMHeader) string(t *testing.T, tag int32) string {
+	t.Helper()
+	return h.strings(t, tag)[0]
+}
+
+func (h parsedRPMHeader) int32s(t *testing.T, tag int32) []int32 {
+	t.Helper()
+	e, ok := h[tag]
+	if !ok || e.typ != rpmInt32 {
+		t.Fatalf("missing int32 tag %d", tag)
+	}
+	res := make([]int32, e.count)
+	if err := binary.Read(bytes.NewReader(e.data), binary.BigEndian, res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Parse a header and return the bytes following it
+func parseRPMHeader(t *testing.T, data []byte, region int32) (h parsedRPMHeader, size int, rest []byte) {
+	t.Helper()
+	if len(data) < 16 || !bytes.Equal(data[:8], []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}) {
+		t.Fatal("missing header magic")
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	storeSize := int(binary.BigEndian.Uint32(data[12:]))
+	size = 16 + 16*count + storeSize
+	if len(data) < size {
+		t.Fatalf("header is truncated: %d < %d", len(data), size)
+	}
+	index := data[16 : 16+16*count]
+	store := data[16+16*count : size]
+	h = parsedRPMHeader{}
+	for i := 0; i < count; i++ {
+		var e [4]int32
+		binary.Read(bytes.NewReader(index[16*i:]), binary.BigEndian, &e)
+		if e[2] < 0 || int(e[2]) > len(store) {
+			t.Fatalf("tag %d has offset %d outside of the store", e[0], e[2])
+		}
+		h[e[0]] = parsedRPMEntry{typ: e[1], count: e[3], data: store[e[2]:]}
+	}
+	// The region trailer points back at the start of the index
+	var trailer [4]int32
+	binary.Read(bytes.NewReader(h[region].data), binary.BigEndian, &trailer)
+	if trailer != [4]int32{region, rpmBin, int32(-16 * count), 16} {
+		t.Errorf("unexpected region trailer %v", trailer)
+	}
+	return h, size, data[size:]
+}
+
+type cpioEntry struct {
+	name    string
+	mode    uint32
+	content string
+}
+
+// Read the entries of a newc cpio archive up to the trailer
+func readCpio(t *testing.T, data []byte) (entries []cpioEntry) {
+	t.Helper()
+	pad := func(n int) int { return (n + 3) &^ 3 }
+	for off := 0; ; {
+		if len(data) < off+110 || string(data[off:off+6]) != "070701" {
+			t.Fatalf("invalid cpio header at %d", off)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[off+6+8*i:off+14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(v)
+		}
+		mode, size, nameSize := field(1), field(6), field(11)
+		name := string(data[off+110 : off+110+nameSize-1])
+		if name == "TRAILER!!!" {
+			return
+		}
+		start := pad(off + 110 + nameSize)
+		entries = append(entries, cpioEntry{name: name, mode: uint32(mode), content: string(data[start : start+size])})
+		off = pad(start + size)
+	}
+}
+
+func TestWriteRPM(t *testing.T) {
+	p := testPackage(t)
+	p.Config.Depends = append(p.Config.Depends, "tzdata > 2024a")
+	loc := filepath.Join(t.TempDir(), RPMName(p, "x86_64"))
+	if err := WriteRPM(loc, p, "x86_64"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 96 || !bytes.Equal(data[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("missing lead magic")
+	}
+	if name := string(bytes.TrimRight(data[10:76], "\x00")); name != "app-1.2.3-1" {
+		t.Errorf("unexpected lead name %q", name)
+	}
+
+	sig, sigSize, rest := parseRPMHeader(t, data[96:], rpmTagHeaderSignatures)
+	if sigSize%8 != 0 {
+		rest = rest[8-sigSize%8:]
+	}
+	h, headerSize, payload := parseRPMHeader(t, rest, rpmTagHeaderImmutable)
+	header := rest[:headerSize]
+
+	if got := sig.int32s(t, rpmSigSize)[0]; int(got) != len(header)+len(payload) {
+		t.Errorf("signature size %d, want %d", got, len(header)+len(payload))
+	}
+	headerSHA256 := sha256.Sum256(header)
+	if got := sig.string(t, rpmSigSHA256); got != hex.EncodeToString(headerSHA256[:]) {
+		t.Errorf("signature sha256 %s doesn't match the header", got)
+	}
+	digest := md5.Sum(append(append([]byte{}, header...), payload...))
+	if got := sig[rpmSigMD5].data[:16]; !bytes.Equal(got, digest[:]) {
+		t.Errorf("signature md5 %x doesn't match", got)
+	}
+
+	for tag, want := range map[int32]string{
+		rpmTagName:          "app",
+		rpmTagVersion:       "1.2.3",
+		rpmTagRelease:       "1",
+		rpmTagSummary:       "An app",
+		rpmTagDescription:   "It does things.\n\nReally.",
+		rpmTagLicense:       "MIT",
+		rpmTagPackager:      "Jane Doe <jane@example.com>",
+		rpmTagURL:           "https://example.com",
+		rpmTagOS:            "linux",
+		rpmTagArch:          "x86_64",
+		rpmTagPostIn:        "#!/bin/sh\necho installed\n",
+		rpmTagPostInProg:    "/bin/sh",
+		rpmTagPayloadFormat: "cpio",
+		rpmTagPayloadCompr:  "gzip",
+	} {
+		if got := h.string(t, tag); got != want {
+			t.Errorf("tag %d = %q, want %q", tag, got, want)
+		}
+	}
+	if _, ok := h[rpmTagPreIn]; ok {
+		t.Error("unexpected preinstall script")
+	}
+	names := h.strings(t, rpmTagRequireName)
+	versions := h.strings(t, rpmTagRequireVersion)
+	flags := h.int32s(t, rpmTagRequireFlags)
+	if len(names) != len(versions) || len(names) != len(flags) {
+		t.Fatalf("require lengths differ: %d, %d, %d", len(names), len(versions), len(flags))
+	}
+	requires := map[string]struct {
+		flags   int32
+		version string
+	}{}
+	for i, name := range names {
+		requires[name] = struct {
+			flags   int32
+			version string
+		}{flags[i], versions[i]}
+	}
+	if r := requires["libc6"]; r.flags != rpmSenseGreater|rpmSenseEqual || r.version != "2.31" {
+		t.Errorf("unexpected libc6 requirement %+v", r)
+	}
+	if r := requires["tzdata"]; r.flags != rpmSenseGreater || r.version != "2024a" {
+		t.Errorf("unexpected tzdata requirement %+v", r)
+	}
+	if r, ok := requires["ca-certificates"]; !ok || r.flags != 0 || r.version != "" {
+		t.Errorf("unexpected ca-certificates requirement %+v", r)
+	}
+
+	if got := h.strings(t, rpmTagDirNames); !reflect.DeepEqual(got, []string{"/etc/app/", "/usr/bin/"}) {
+		t.Errorf("unexpected dir names %q", got)
+	}
+	if got := h.strings(t, rpmTagBaseNames); !reflect.DeepEqual(got, []string{"conf.yml", "app"}) {
+		t.Errorf("unexpected base names %q", got)
+	}
+	if got := h.int32s(t, rpmTagFileFlags); got[0] != rpmFileConfigNoReplace || got[1] != 0 {
+		t.Errorf("unexpected file flags %v", got)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpio, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := readCpio(t, cpio)
+	if len(entries) != len(p.Files) {
+		t.Fatalf("expected %d payload entries, got %d", len(p.Files), len(entries))
+	}
+	var total int32
+	for i, f := range p.Files {
+		content, _ := os.ReadFile(f.Src)
+		want := cpioEntry{name: "." + f.Dest, mode: 0100000 | uint32(f.Mode), content: string(content)}
+		if entries[i] != want {
+			t.Errorf("payload entry %d = %+v, want %+v", i, entries[i], want)
+		}
+		total += int32(len(content))
+	}
+	if got := h.int32s(t, rpmTagSize)[0]; got != total {
+		t.Errorf("size %d, want %d", got, total)
+	}
+	if got := sig.int32s(t, rpmSigPayloadSize)[0]; int(got) != len(cpio) {
+		t.Errorf("payload size %d, want %d", got, len(cpio))
+	}
+}
+
+func TestRPMDependency(t *testing.T) {
+	cases := []struct {
+		dep     string
+		name    string
+		flags   int32
+		version string
+	}{
+		{"bash", "bash", 0, ""},
+		{"bash >= 5", "bash", rpmSenseGreater | rpmSenseEqual, "5"},
+		{"bash (< 5.1)", "bash", rpmSenseLess, "5.1"},
+		{"bash<=5.1", "bash", rpmSenseLess | rpmSenseEqual, "5.1"},
+		{"bash = 5.1-2", "bash", rpmSenseEqual, "5.1-2"},
+	}
+	for _, c := range cases {
+		name, flags, version := rpmDependency(c.dep)
+		if name != c.name || flags != c.flags || version != c.version {
+			t.Errorf("rpmDependency(%q) = %q, %d, %q, want %q, %d, %q", c.dep, name, flags, version, c.name, c.flags, c.version)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var scoopArchs = map[string]string{
+	"amd64": "64bit",
+	"386":   "32bit",
+	"arm64": "arm64",
+}
+
+type ScoopArch struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"`
+}
+
+type ScoopManifest struct {
+	Version      string               `json:"version"`
+	Description  string               `json:"description,omitempty"`
+	Homepage     string               `json:"homepage,omitempty"`
+	License      string               `json:"license,omitempty"`
+	Architecture map[string]ScoopArch `json:"architecture"`
+	Bin          []string             `json:"bin"`
+}
+
+// Create the Scoop manifest for the windows bundles of a group
+func NewScoopManifest(config BuildConfig, group PublishGroup) (m ScoopManifest, ok bool, err error) {
+	desc, _, _ := StringCut(strings.TrimSpace(config.Packaging.Description), "\n")
+	m = ScoopManifest{
+		Version:      PublishVersion(config),
+		Description:  desc,
+		Homepage:     config.Packaging.Homepage,
+		License:      config.Packaging.License,
+		Architecture: map[string]ScoopArch{},
+	}
+	for _, a := range group.Artifacts {
+		arch, found := scoopArchs[a.GOARCH]
+		if a.GOOS != "windows" || !found {
+			continue
+		}
+		url, err := group.URL(config, a)
+		if err != nil {
+			return m, false, err
+		}
+		m.Architecture[arch] = ScoopArch{URL: url, Hash: a.SHA256}
+		if m.Bin == nil {
+			if m.Bin, err = group.BinaryNames(config, a.Distribution()); err != nil {
+				return m, false, err
+			}
+		}
+	}
+	return m, len(m.Architecture) > 0, nil
+}
+
+// Write the manifest to the bucket directory
+func WriteScoopManifest(bucket, name string, m ScoopManifest) (loc string, err error) {
+	loc = filepath.Join(bucket, name+".json")
+	if err = os.MkdirAll(bucket, 0755); err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return
+	}
+	return loc, os.WriteFile(loc, append(data, '\n'), 0644)
+}
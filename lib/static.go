@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+)
+
+// Build tags which avoid cgo in the net and os/user packages
+var staticTags = []string{"netgo", "osusergo"}
+
+// Only linux targets are built statically
+func IsStatic(config BuildConfig, dist Distribution) bool {
+	return config.Static && dist.GOOS == "linux"
+}
+
+// Arguments for go build which produce a static binary
+func StaticArgs(args []string) []string {
+	return AddBuildTags(args, staticTags...)
+}
+
+// Linker flags which produce a static binary. Only needed when cgo is enabled.
+func StaticLdFlags(config BuildConfig) string {
+	if !config.CGO {
+		return ""
+	}
+	return `-linkmode external -extldflags "-static"`
+}
+
+// Add tags to the -tags flag in args or append the flag if it's missing
+func AddBuildTags(args []string, tags ...string) (res []string) {
+	res = make([]string, len(args))
+	copy(res, args)
+	joined := strings.Join(tags, ",")
+	for i, arg := range res {
+		name := strings.TrimPrefix(arg, "-")
+		switch {
+		case (name == "tags" || name == "-tags") && i+1 < len(res):
+			res[i+1] = mergeTags(res[i+1], joined)
+			return
+		case strings.HasPrefix(name, "tags=") || strings.HasPrefix(name, "-tags="):
+			flag, val, _ := StringCut(arg, "=")
+			res[i] = flag + "=" + mergeTags(val, joined)
+			return
+		}
+	}
+	return append(res, "-tags", joined)
+}
+
+func mergeTags(existing, tags string) string {
+	if existing == "" {
+		return tags
+	}
+	return existing + "," + tags
+}
+
+// Check that an ELF binary doesn't use a dynamic interpreter or libraries
+func CheckStatic(loc string) (err error) {
+	f, err := elf.Open(loc)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("%s is dynamically linked", loc)
+		}
+	}
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return
+	}
+	if len(libs) > 0 {
+		return fmt.Errorf("%s is dynamically linked against %s", loc, strings.Join(libs, ", "))
+	}
+	return
+}
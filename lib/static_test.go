@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestAddBuildTags(t *testing.T) {
+	cases := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{}, []string{"-tags", "netgo,osusergo"}},
+		{[]string{"-trimpath"}, []string{"-trimpath", "-tags", "netgo,osusergo"}},
+		{[]string{"-tags", "prod"}, []string{"-tags", "prod,netgo,osusergo"}},
+		{[]string{"--tags", "prod", "-v"}, []string{"--tags", "prod,netgo,osusergo", "-v"}},
+		{[]string{"-tags=prod"}, []string{"-tags=prod,netgo,osusergo"}},
+		{[]string{"--tags=prod"}, []string{"--tags=prod,netgo,osusergo"}},
+		{[]string{"-tags="}, []string{"-tags=netgo,osusergo"}},
+		{[]string{"-tags", ""}, []string{"-tags", "netgo,osusergo"}},
+	}
+	for _, c := range cases {
+		args := append([]string{}, c.args...)
+		got := AddBuildTags(c.args, staticTags...)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("AddBuildTags(%q) = %q, want %q", c.args, got, c.want)
+		}
+		if !reflect.DeepEqual(c.args, args) {
+			t.Errorf("AddBuildTags(%q) modified its arguments", args)
+		}
+	}
+}
+
+func TestIsStatic(t *testing.T) {
+	config := BuildConfig{Static: true}
+	if !IsStatic(config, Distribution{GOOS: "linux", GOARCH: "arm64"}) {
+		t.Error("linux targets should be static")
+	}
+	if IsStatic(config, Distribution{GOOS: "windows", GOARCH: "amd64"}) {
+		t.Error("windows targets shouldn't be static")
+	}
+	if IsStatic(BuildConfig{}, Distribution{GOOS: "linux", GOARCH: "amd64"}) {
+		t.Error("targets shouldn't be static without -static")
+	}
+}
+
+func TestCheckStatic(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires an ELF binary")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not found")
+	}
+	if err := CheckStatic("/bin/sh"); err == nil {
+		t.Error("expected /bin/sh to be dynamically linked")
+	}
+}
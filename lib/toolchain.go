@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"go/version"
+	"strings"
+)
+
+type Toolchain struct {
+	// Value for GOTOOLCHAIN. Empty leaves it unchanged.
+	Name string
+	// Path to the go binary. Empty means "go" on the PATH.
+	GoBin string
+	// Version reported by the toolchain. Ex: go1.22.1
+	Version string
+}
+
+func (t Toolchain) String() string {
+	if t.GoBin != "" {
+		return t.GoBin
+	}
+	return t.Name
+}
+
+type Toolchains []Toolchain
+
+// Parse a toolchain which is either a GOTOOLCHAIN value like go1.20.14 or the
+// path to a go binary
+func (t *Toolchains) Set(val string) error {
+	if val == "" {
+		return fmt.Errorf("must supply a toolchain")
+	}
+	if strings.ContainsAny(val, `/\`) {
+		*t = append(*t, Toolchain{GoBin: val})
+	} else {
+		*t = append(*t, Toolchain{Name: val})
+	}
+	return nil
+}
+
+func (t *Toolchains) String() string {
+	vals := make([]string, len(*t))
+	for i, tc := range *t {
+		vals[i] = tc.String()
+	}
+	return strings.Join(vals, ",")
+}
+
+// Ask the toolchain which version it is
+func ToolchainVersion(config BuildConfig, tc Toolchain) (version string, err error) {
+	config.Toolchain = tc
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	cmd := GoCommand(config, "env", "GOVERSION")
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+	if err = cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to get version of toolchain %s: %w\n%s", tc, err, errBuf.String())
+	}
+	return parseToolchainVersion(buf.String())
+}
+
+// Extract the release from the output of go env GOVERSION. Suffixes like the
+// experiments in "go1.22.1 X:rangefunc" are dropped and development builds
+// like "devel go1.24-abcdef ..." use the release they lead up to.
+func parseToolchainVersion(out string) (v string, err error) {
+	fields := strings.Fields(out)
+	if len(fields) > 1 && fields[0] == "devel" {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "go") {
+		v = normalizeGoVersion(fields[0])
+	}
+	if !version.IsValid(v) {
+		return "", fmt.Errorf("unexpected toolchain version %q", strings.TrimSpace(out))
+	}
+	return v, nil
+}
+
+// Resolve the version of each configured toolchain. The toolchain on the PATH
+// is used when none are configured.
+func ResolveToolchains(config BuildConfig) (res Toolchains, err error) {
+	res = append(res, config.Toolchains...)
+	if len(res) == 0 {
+		res = Toolchains{{}}
+	}
+	for i := range res {
+		if res[i].Version, err = ToolchainVersion(config, res[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// The minimum toolchain version required by the go and toolchain directives
+// of the module. Ex: go1.21.0
+func (m GoModule) RequiredGoVersion() (version string) {
+	if m.GoVersion != "" {
+		version = "go" + m.GoVersion
+	}
+	if m.Toolchain != "" && m.Toolchain != "default" && CompareGoVersions(m.Toolchain, version) > 0 {
+		version = m.Toolchain
+	}
+	return
+}
+
+// Check that the toolchain is at least as new as the module requires
+func CheckToolchain(mod GoModule, tc Toolchain) error {
+	required := mod.RequiredGoVersion()
+	if required != "" && CompareGoVersions(tc.Version, required) < 0 {
+		return fmt.Errorf("toolchain %s is older than %s required by %s", tc.Version, required, mod.Path)
+	}
+	return nil
+}
+
+// Compare two Go versions like 1.21, go1.21.3 or go1.22rc1 with the rules of
+// the go command where go1.21 < go1.21rc1 < go1.21.0. The result is -1 if
+// a < b, 0 if a == b and 1 if a > b.
+func CompareGoVersions(a, b string) int {
+	return version.Compare(normalizeGoVersion(a), normalizeGoVersion(b))
+}
+
+// Add the go prefix to a version and drop suffixes like the experiments in
+// "go1.22.1 X:rangefunc" or the "-abcdef" of a development build
+func normalizeGoVersion(v string) string {
+	v, _, _ = StringCutAny(strings.TrimSpace(v), " ", "-")
+	if !strings.HasPrefix(v, "go") {
+		v = "go" + v
+	}
+	return v
+}
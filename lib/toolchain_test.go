@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestToolchainsSet(t *testing.T) {
+	var tcs Toolchains
+	for _, val := range []string{"go1.21.13", "/usr/local/go/bin/go", `C:\Go\bin\go.exe`, "local"} {
+		if err := tcs.Set(val); err != nil {
+			t.Fatalf("Set(%q) failed: %s", val, err)
+		}
+	}
+	want := Toolchains{
+		{Name: "go1.21.13"},
+		{GoBin: "/usr/local/go/bin/go"},
+		{GoBin: `C:\Go\bin\go.exe`},
+		{Name: "local"},
+	}
+	if !reflect.DeepEqual(tcs, want) {
+		t.Errorf("got %+v, want %+v", tcs, want)
+	}
+	if got := tcs.String(); got != `go1.21.13,/usr/local/go/bin/go,C:\Go\bin\go.exe,local` {
+		t.Errorf("String() = %q", got)
+	}
+	if err := tcs.Set(""); err == nil {
+		t.Error("Set(\"\") expected an error")
+	}
+}
+
+func TestCompareGoVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"go1.21", "go1.21", 0},
+		{"go1.21", "go1.21rc1", -1},
+		{"go1.21rc1", "go1.21.0", -1},
+		{"go1.20", "go1.20.0", 0},
+		{"1.21.3", "go1.21.3", 0},
+		{"go1.21.3", "go1.21.10", -1},
+		{"go1.22.0", "go1.21.13", 1},
+		{"go1.22rc1", "go1.22.0", -1},
+		{"go1.22rc2", "go1.22rc1", 1},
+		{"go1.22beta1", "go1.22rc1", -1},
+		{"go1.22alpha1", "go1.22beta1", -1},
+		{"go1.22.1 X:rangefunc", "go1.22.1", 0},
+		{"go1.23.0-bigcorp", "go1.23.0", 0},
+		{"go2", "go1.99.9", 1},
+	}
+	for _, c := range cases {
+		if got := CompareGoVersions(c.a, c.b); got != c.want {
+			t.Errorf("CompareGoVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := CompareGoVersions(c.b, c.a); got != -c.want {
+			t.Errorf("CompareGoVersions(%q, %q) = %d, want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
+
+func TestParseToolchainVersion(t *testing.T) {
+	cases := []struct {
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{out: "go1.22.1\n", want: "go1.22.1"},
+		{out: "go1.22.1 X:rangefunc\n", want: "go1.22.1"},
+		{out: "go1.23rc1", want: "go1.23rc1"},
+		{out: "devel go1.24-abcdef Tue Jan 2 15:04:05 2024 +0000", want: "go1.24"},
+		{out: "go1.21.0-bigcorp", want: "go1.21.0"},
+		{out: "", wantErr: true},
+		{out: "devel", wantErr: true},
+		{out: "unknown", wantErr: true},
+		{out: "go1.21.x", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseToolchainVersion(c.out)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseToolchainVersion(%q) expected an error", c.out)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("parseToolchainVersion(%q) = %q, %v, want %q", c.out, got, err, c.want)
+		}
+	}
+}
+
+func TestCheckToolchain(t *testing.T) {
+	cases := []struct {
+		mod     GoModule
+		version string
+		wantErr bool
+	}{
+		{GoModule{GoVersion: "1.21"}, "go1.21.0", false},
+		{GoModule{GoVersion: "1.21.5"}, "go1.21.4", true},
+		{GoModule{GoVersion: "1.21", Toolchain: "go1.22.2"}, "go1.22.0", true},
+		{GoModule{GoVersion: "1.21", Toolchain: "default"}, "go1.21.0", false},
+		{GoModule{}, "go1.18", false},
+	}
+	for _, c := range cases {
+		err := CheckToolchain(c.mod, Toolchain{Version: c.version})
+		if (err != nil) != c.wantErr {
+			t.Errorf("CheckToolchain(%+v, %s) = %v, want error %v", c.mod, c.version, err, c.wantErr)
+		}
+	}
+}
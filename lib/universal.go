@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// GOARCH of the bundles with universal darwin binaries
+const UniversalArch = "universal"
+
+// The thin distributions merged into a universal binary
+var UniversalDistributions = DistributionSet{
+	{GOOS: "darwin", GOARCH: "amd64"},
+	{GOOS: "darwin", GOARCH: "arm64"},
+}
+
+// Segment alignment used by lipo as a power of 2
+func machoAlign(cpu macho.Cpu) uint32 {
+	if cpu == macho.CpuArm64 || cpu == macho.CpuArm {
+		return 14
+	}
+	return 12
+}
+
+// Merge thin Mach-O binaries into a universal binary the same way as lipo
+func MergeMachO(w io.Writer, thin ...[]byte) (err error) {
+	archs := make([]macho.FatArchHeader, len(thin))
+	offset := uint64(8 + 20*len(thin))
+	for i, data := range thin {
+		f, err := macho.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("not a thin Mach-O binary: %w", err)
+		}
+		for _, arch := range archs[:i] {
+			if arch.Cpu == f.Cpu {
+				return fmt.Errorf("duplicate Mach-O architecture %s", f.Cpu)
+			}
+		}
+		align := machoAlign(f.Cpu)
+		offset = (offset + 1<<align - 1) &^ (1<<align - 1)
+		archs[i] = macho.FatArchHeader{Cpu: f.Cpu, SubCpu: f.SubCpu, Offset: uint32(offset), Size: uint32(len(data)), Align: align}
+		offset += uint64(len(data))
+		if offset > math.MaxUint32 {
+			return fmt.Errorf("universal binary is too large: %d bytes", offset)
+		}
+	}
+	if err = binary.Write(w, binary.BigEndian, [2]uint32{macho.MagicFat, uint32(len(thin))}); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, archs); err != nil {
+		return
+	}
+	written := uint64(8 + 20*len(thin))
+	for i, data := range thin {
+		if _, err = w.Write(make([]byte, uint64(archs[i].Offset)-written)); err != nil {
+			return
+		}
+		if _, err = w.Write(data); err != nil {
+			return
+		}
+		written = uint64(archs[i].Offset) + uint64(len(data))
+	}
+	return
+}
+
+// Merge the binaries of the thin darwin bundles of a group into a
+// darwin/universal bundle
+func BuildUniversal(config BuildConfig, group PublishGroup, thin []Artifact) (a Artifact, err error) {
+	return buildUniversal(config, group, thin, ArtifactBundle)
+}
+
+// Merge the debug binaries of the thin darwin debug artifacts of a group into
+// a darwin/universal debug artifact
+func BuildUniversalDebug(config BuildConfig, group PublishGroup, thin []Artifact) (a Artifact, err error) {
+	return buildUniversal(config, group, thin, ArtifactDebug)
+}
+
+func buildUniversal(config BuildConfig, group PublishGroup, thin []Artifact, kind string) (a Artifact, err error) {
+	dist := Distribution{GOOS: "darwin", GOARCH: UniversalArch}
+	suffix := ""
+	if kind == ArtifactDebug {
+		suffix = ".debug"
+	}
+	outDir, err := filepath.Abs(config.OutputDir)
+	if err != nil {
+		return
+	}
+	names, err := group.BinaryNames(config, dist)
+	if err != nil {
+		return
+	}
+	merged := make([][][]byte, len(names))
+	for _, t := range thin {
+		thinNames, err := group.BinaryNames(config, t.Distribution())
+		if err != nil {
+			return a, err
+		}
+		var files []ociFile
+		if kind == ArtifactDebug {
+			files, err = readDebugBinaries(config, t, thinNames)
+		} else {
+			files, err = readBundleBinaries(config, t, thinNames, "")
+		}
+		if err != nil {
+			return a, err
+		}
+		for i, f := range files {
+			merged[i] = append(merged[i], f.Content)
+		}
+	}
+	entries := make([]BundleEntry, len(names))
+	for i, name := range names {
+		binPath := filepath.Join(outDir, group.Binaries[i].Name+suffix)
+		entries[i] = BundleEntry{Name: name + suffix, Path: binPath}
+		defer os.Remove(binPath)
+		if err = writeUniversal(binPath, merged[i]); err != nil {
+			return a, fmt.Errorf("failed to merge %s: %w", name, err)
+		}
+	}
+	if kind == ArtifactDebug {
+		finalPath, err := RenderDebugPath(config, dist, group.Bundle)
+		if err != nil {
+			return a, err
+		}
+		if err = BundleTarGz(finalPath, entries, config); err != nil {
+			return a, err
+		}
+		if a, err = NewArtifact(finalPath, kind, dist, config, group.Binaries); err != nil {
+			return a, err
+		}
+		return universalMetadata(a, thin), nil
+	}
+	finalPath, err := RenderBundlePath(config, dist, group.Bundle)
+	if err != nil {
+		return
+	}
+	if err = BundleFile(finalPath, entries, config); err != nil {
+		return
+	}
+	if a, err = NewArtifact(finalPath, kind, dist, config, group.Binaries); err != nil {
+		return
+	}
+	return universalMetadata(a, thin), nil
+}
+
+// Copy the build IDs and compressed sizes of the thin artifacts into a
+// universal artifact keyed by binary and architecture like app/arm64
+func universalMetadata(a Artifact, thin []Artifact) Artifact {
+	for _, t := range thin {
+		for name, id := range t.BuildIDs {
+			if a.BuildIDs == nil {
+				a.BuildIDs = map[string]string{}
+			}
+			a.BuildIDs[name+"/"+t.GOARCH] = id
+		}
+		for name, size := range t.Sizes {
+			if a.Sizes == nil {
+				a.Sizes = map[string]CompressedSize{}
+			}
+			a.Sizes[name+"/"+t.GOARCH] = size
+		}
+	}
+	return a
+}
+
+func writeUniversal(loc string, thin [][]byte) (err error) {
+	outf, err := os.OpenFile(loc, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return
+	}
+	if err = MergeMachO(outf, thin...); err != nil {
+		outf.Close()
+		return
+	}
+	return outf.Close()
+}
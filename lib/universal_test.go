@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// A thin 64-bit Mach-O executable without load commands followed by a payload
+func thinMachO(cpu macho.Cpu, payload string) []byte {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, macho.FileHeader{Magic: macho.Magic64, Cpu: cpu, SubCpu: 3, Type: macho.TypeExec})
+	buf.Write(make([]byte, 4))
+	buf.WriteString(payload)
+	return buf.Bytes()
+}
+
+func TestMergeMachO(t *testing.T) {
+	thin := [][]byte{thinMachO(macho.CpuAmd64, "amd64 code"), thinMachO(macho.CpuArm64, "arm64 code")}
+	buf := bytes.NewBuffer(nil)
+	if err := MergeMachO(buf, thin...); err != nil {
+		t.Fatal(err)
+	}
+	fat, err := macho.NewFatFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fat.Magic != macho.MagicFat || len(fat.Arches) != len(thin) {
+		t.Fatalf("unexpected fat header %x with %d arches", fat.Magic, len(fat.Arches))
+	}
+	for i, arch := range fat.Arches {
+		want, _ := macho.NewFile(bytes.NewReader(thin[i]))
+		if arch.Cpu != want.Cpu || arch.SubCpu != want.SubCpu {
+			t.Errorf("arch %d is %s/%d, want %s/%d", i, arch.Cpu, arch.SubCpu, want.Cpu, want.SubCpu)
+		}
+		if arch.Offset%(1<<arch.Align) != 0 || arch.Align != machoAlign(arch.Cpu) {
+			t.Errorf("arch %d has offset %d with align %d", i, arch.Offset, arch.Align)
+		}
+		data := buf.Bytes()[arch.Offset : arch.Offset+arch.Size]
+		if !bytes.Equal(data, thin[i]) {
+			t.Errorf("arch %d doesn't contain the thin binary", i)
+		}
+	}
+	if fat.Arches[0].Offset != 1<<12 || fat.Arches[1].Offset != 1<<14 {
+		t.Errorf("unexpected offsets %d and %d", fat.Arches[0].Offset, fat.Arches[1].Offset)
+	}
+}
+
+func TestMergeMachOInvalid(t *testing.T) {
+	amd64 := thinMachO(macho.CpuAmd64, "code")
+	if err := MergeMachO(bytes.NewBuffer(nil), amd64, amd64); err == nil {
+		t.Error("expected an error for duplicate architectures")
+	}
+	if err := MergeMachO(bytes.NewBuffer(nil), amd64, []byte("\x7fELF not a Mach-O binary")); err == nil {
+		t.Error("expected an error for a binary which isn't Mach-O")
+	}
+}
+
+func TestUniversalMetadata(t *testing.T) {
+	thin := []Artifact{
+		{GOARCH: "amd64", BuildIDs: map[string]string{"app": "a1"}, Sizes: map[string]CompressedSize{"app": {Original: 10, Compressed: 5}}},
+		{GOARCH: "arm64", BuildIDs: map[string]string{"app": "b1"}},
+	}
+	a := universalMetadata(Artifact{GOARCH: UniversalArch}, thin)
+	if want := map[string]string{"app/amd64": "a1", "app/arm64": "b1"}; !reflect.DeepEqual(a.BuildIDs, want) {
+		t.Errorf("BuildIDs = %v, want %v", a.BuildIDs, want)
+	}
+	if want := map[string]CompressedSize{"app/amd64": {Original: 10, Compressed: 5}}; !reflect.DeepEqual(a.Sizes, want) {
+		t.Errorf("Sizes = %v, want %v", a.Sizes, want)
+	}
+	if a = universalMetadata(Artifact{}, []Artifact{{GOARCH: "amd64"}}); a.BuildIDs != nil || a.Sizes != nil {
+		t.Errorf("expected no metadata without thin metadata, got %+v", a)
+	}
+}
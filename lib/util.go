@@ -198,3 +198,41 @@ func CleanDirGlob(dir, pattern string) error {
 	}
 	return nil
 }
+
+// Split a command line into arguments. Single and double quotes group
+// arguments containing spaces.
+func SplitArgs(val string) (args []string, err error) {
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range val {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", val)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		val     string
+		want    []string
+		wantErr bool
+	}{
+		{val: "upx --best", want: []string{"upx", "--best"}},
+		{val: "  go   vet\t./...\n", want: []string{"go", "vet", "./..."}},
+		{val: `sh -c "echo hello world"`, want: []string{"sh", "-c", "echo hello world"}},
+		{val: `echo 'a "b" c'`, want: []string{"echo", `a "b" c`}},
+		{val: `echo "it's"`, want: []string{"echo", "it's"}},
+		{val: `-X 'main.name=a b'`, want: []string{"-X", "main.name=a b"}},
+		{val: `pre"fix"post`, want: []string{"prefixpost"}},
+		{val: `echo "" ''`, want: []string{"echo", "", ""}},
+		{val: "", wantErr: true},
+		{val: " \t ", wantErr: true},
+		{val: `echo "unterminated`, wantErr: true},
+		{val: `echo 'unterminated`, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := SplitArgs(c.val)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("SplitArgs(%q) expected an error", c.val)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("SplitArgs(%q) = %q, %v, want %q", c.val, got, err, c.want)
+		}
+	}
+}
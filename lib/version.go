@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+)
+
+const DefaultVersion = "dev"
+
+// Describe the current commit using the most recent tag. Ex: v1.2.3 or
+// v1.2.3-4-gabcdef0
+func GitVersion(dir string) string {
+	buf := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(context.Background(), "git", "describe", "--tags", "--always")
+	cmd.Dir = dir
+	cmd.Stdout = buf
+	if err := cmd.Run(); err != nil {
+		return DefaultVersion
+	}
+	if version := strings.TrimSpace(buf.String()); version != "" {
+		return version
+	}
+	return DefaultVersion
+}
@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const WasmExecName = "wasm_exec.js"
+
+var tinyGoTargets = map[string]string{
+	"js":     "wasm",
+	"wasip1": "wasip1",
+}
+
+var wasmHTMLTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.Name}}</title>
+  <script src="` + WasmExecName + `"></script>
+  <script>
+    const go = new Go();
+    WebAssembly.instantiateStreaming(fetch({{.Wasm}}), go.importObject).then((result) => {
+      go.run(result.instance);
+    });
+  </script>
+</head>
+<body></body>
+</html>
+`))
+
+type WasmConfig struct {
+	// Include wasm_exec.js from the compiler in js/wasm bundles
+	Exec bool
+	// Generate an index.html which loads the first binary of js/wasm bundles
+	HTML bool
+	// Build the wasm targets with TinyGo instead of the Go toolchain
+	TinyGo        bool
+	TinyGoVersion string
+}
+
+func IsWasm(dist Distribution) bool {
+	return dist.GOARCH == "wasm"
+}
+
+// Check if a distribution is built with TinyGo
+func UsesTinyGo(config BuildConfig, dist Distribution) bool {
+	return config.Wasm.TinyGo && IsWasm(dist)
+}
+
+// Check if the loader assets are added to the bundles of a distribution
+func (c WasmConfig) HasLoader(dist Distribution) bool {
+	return (c.Exec || c.HTML) && dist.GOOS == "js" && IsWasm(dist)
+}
+
+// Create a tinygo command which shares the environment of the go command
+func TinyGoCommand(config BuildConfig, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(context.Background(), "tinygo", args...)
+	cmd.Dir = config.Dir
+	cmd.Env = GoCommand(config).Env
+	return cmd
+}
+
+// Ask TinyGo which version it is
+func TinyGoVersion(config BuildConfig) (version string, err error) {
+	out, err := commandOutput(TinyGoCommand(config, "version"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get version of tinygo: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// The settings which don't apply to the targets built with TinyGo
+func TinyGoUnsupported(config BuildConfig) (flags []string) {
+	if config.Reproducible {
+		flags = append(flags, "-reproducible")
+	}
+	if config.Static {
+		flags = append(flags, "-static")
+	}
+	if config.SplitDebug {
+		flags = append(flags, "-split-debug")
+	}
+	if config.CGO {
+		flags = append(flags, "-cgo")
+	}
+	if config.CgoPreset != "" {
+		flags = append(flags, "-cgo-preset")
+	}
+	if len(config.CgoEnvs) > 0 {
+		flags = append(flags, "-cgo-env")
+	}
+	return
+}
+
+// Arguments for tinygo build which produce the same binary as go build where
+// TinyGo supports it. The go build flags and linker flags which TinyGo doesn't
+// support are returned as ignored.
+func TinyGoBuildArgs(config BuildConfig, dist Distribution, bin Binary, outPath string) (args, ignored []string, err error) {
+	target, ok := tinyGoTargets[dist.GOOS]
+	if !ok || !IsWasm(dist) {
+		return nil, nil, fmt.Errorf("tinygo does not support %s/%s", dist.GOOS, dist.GOARCH)
+	}
+	args = []string{"build", "-o", outPath, "-target", target}
+	if !config.Debug {
+		args = append(args, "-no-debug")
+	}
+	if strings.TrimSpace(config.LdFlags) != "" {
+		ldFlags, ldIgnored, err := tinyGoLdFlags(config.LdFlags)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ldFlags != "" {
+			args = append(args, "-ldflags", ldFlags)
+		}
+		for _, flag := range ldIgnored {
+			ignored = append(ignored, "-ldflags "+flag)
+		}
+	}
+	buildArgs, buildIgnored := tinyGoBuildFlags(append(append([]string{}, config.BuildArgs...), bin.BuildArgs...))
+	args = append(args, buildArgs...)
+	ignored = append(ignored, buildIgnored...)
+	if bin.Package != "" {
+		args = append(args, bin.Package)
+	}
+	return
+}
+
+// The go build flags which take a value
+var goBuildValueFlags = []string{"C", "p", "asmflags", "buildmode", "compiler", "covermode", "coverpkg", "gccgoflags", "gcflags", "installsuffix", "ldflags", "mod", "modfile", "o", "overlay", "pgo", "pkgdir", "tags", "toolexec"}
+
+// The go build flags which tinygo build also supports
+var tinyGoBuildFlagNames = []string{"p", "tags", "work", "x"}
+
+// Split go build flags into the ones TinyGo supports and the ignored ones
+func tinyGoBuildFlags(args []string) (res, ignored []string) {
+	for i := 0; i < len(args); i++ {
+		flag := []string{args[i]}
+		isFlag := strings.HasPrefix(args[i], "-")
+		name, _, hasValue := StringCut(strings.TrimLeft(args[i], "-"), "=")
+		if isFlag && !hasValue && StringSliceContains(goBuildValueFlags, name) && i+1 < len(args) {
+			i++
+			flag = append(flag, args[i])
+		}
+		if isFlag && StringSliceContains(tinyGoBuildFlagNames, name) {
+			res = append(res, flag...)
+		} else {
+			ignored = append(ignored, strings.Join(flag, " "))
+		}
+	}
+	return
+}
+
+// Keep the -X linker flags since TinyGo doesn't support any others
+func tinyGoLdFlags(ldFlags string) (res string, ignored []string, err error) {
+	args, err := SplitArgs(ldFlags)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid -ldflags: %w", err)
+	}
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-X" || args[i] == "--X") && i+1 < len(args):
+			i++
+			kept = append(kept, "-X", args[i])
+		case strings.HasPrefix(args[i], "-X="):
+			kept = append(kept, args[i])
+		default:
+			ignored = append(ignored, args[i])
+		}
+	}
+	for i, arg := range kept {
+		if strings.ContainsAny(arg, " \t") {
+			kept[i] = "'" + arg + "'"
+		}
+	}
+	return strings.Join(kept, " "), ignored, nil
+}
+
+// Find the wasm_exec.js which matches the compiler of a distribution. Go moved
+// it from misc/wasm to lib/wasm in 1.24.
+func WasmExecPath(config BuildConfig, dist Distribution) (loc string, err error) {
+	var candidates []string
+	if UsesTinyGo(config, dist) {
+		root, err := commandOutput(TinyGoCommand(config, "env", "TINYGOROOT"))
+		if err != nil {
+			return "", fmt.Errorf("failed to find TINYGOROOT: %w", err)
+		}
+		candidates = []string{filepath.Join(strings.TrimSpace(root), "targets", WasmExecName)}
+	} else {
+		root, err := commandOutput(GoCommand(config, "env", "GOROOT"))
+		if err != nil {
+			return "", fmt.Errorf("failed to find GOROOT: %w", err)
+		}
+		root = strings.TrimSpace(root)
+		candidates = []string{filepath.Join(root, "lib", "wasm", WasmExecName), filepath.Join(root, "misc", "wasm", WasmExecName)}
+	}
+	for _, loc := range candidates {
+		if _, err = os.Stat(loc); err == nil {
+			return loc, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", WasmExecName, strings.Join(candidates, ", "))
+}
+
+// Write an index.html which runs a js/wasm binary with wasm_exec.js
+func WriteWasmHTML(loc, name, wasm string) (err error) {
+	outf, err := os.Create(loc)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	return wasmHTMLTemplate.Execute(outf, map[string]string{"Name": name, "Wasm": wasm})
+}
+
+func commandOutput(cmd *exec.Cmd) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w\n%s", err, errBuf.String())
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const wingetManifestVersion = "1.6.0"
+
+var wingetArchs = map[string]string{
+	"amd64": "x64",
+	"386":   "x86",
+	"arm64": "arm64",
+}
+
+var wingetTemplates = template.Must(template.New("winget").Funcs(template.FuncMap{
+	"quote": yamlQuote,
+	"trimExe": func(name string) string {
+		return strings.TrimSuffix(name, ".exe")
+	},
+}).Parse(`
+{{- define "version" -}}
+# Created with gbuild
+PackageIdentifier: {{quote .ID}}
+PackageVersion: {{quote .Version}}
+DefaultLocale: en-US
+ManifestType: version
+ManifestVersion: ` + wingetManifestVersion + `
+{{end}}
+
+{{- define "installer" -}}
+# Created with gbuild
+PackageIdentifier: {{quote .ID}}
+PackageVersion: {{quote .Version}}
+InstallerType: zip
+NestedInstallerType: portable
+NestedInstallerFiles:
+{{- range .Binaries}}
+- RelativeFilePath: {{quote .}}
+  PortableCommandAlias: {{quote (trimExe .)}}
+{{- end}}
+Installers:
+{{- range .Installers}}
+- Architecture: {{.Arch}}
+  InstallerUrl: {{quote .URL}}
+  InstallerSha256: {{.SHA256}}
+{{- end}}
+ManifestType: installer
+ManifestVersion: ` + wingetManifestVersion + `
+{{end}}
+
+{{- define "locale" -}}
+# Created with gbuild
+PackageIdentifier: {{quote .ID}}
+PackageVersion: {{quote .Version}}
+PackageLocale: en-US
+Publisher: {{quote .Publisher}}
+PackageName: {{quote .Name}}
+{{- if .Homepage}}
+PackageUrl: {{quote .Homepage}}
+{{- end}}
+License: {{quote .License}}
+ShortDescription: {{quote .Description}}
+ManifestType: defaultLocale
+ManifestVersion: ` + wingetManifestVersion + `
+{{end}}
+`))
+
+type wingetInstaller struct {
+	Arch   string
+	URL    string
+	SHA256 string
+}
+
+type WingetManifest struct {
+	// Package identifier in the form of Publisher.Package
+	ID          string
+	Version     string
+	Publisher   string
+	Name        string
+	Homepage    string
+	License     string
+	Description string
+	Binaries    []string
+	Installers  []wingetInstaller
+}
+
+// Double quoted YAML strings use the same escapes as JSON
+func yamlQuote(val string) string {
+	data, _ := json.Marshal(val)
+	return string(data)
+}
+
+// Check that a winget package identifier has a publisher and a package name
+func ValidateWingetID(id string) error {
+	parts := strings.Split(id, ".")
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid winget id %q: expected Publisher.Package", id)
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, `/\ `) {
+			return fmt.Errorf("invalid winget id %q: expected Publisher.Package", id)
+		}
+	}
+	return nil
+}
+
+// Create the winget manifests for the windows bundles of a group
+func NewWingetManifest(config BuildConfig, group PublishGroup) (m WingetManifest, ok bool, err error) {
+	desc, _, _ := StringCut(strings.TrimSpace(config.Packaging.Description), "\n")
+	if desc == "" {
+		desc = group.Name
+	}
+	id := config.Publish.WingetID
+	if config.SeparateBundles {
+		id += "." + group.Name
+	}
+	publisher, _, _ := StringCut(id, ".")
+	license := config.Packaging.License
+	if license == "" {
+		license = "Proprietary"
+	}
+	m = WingetManifest{
+		ID:          id,
+		Version:     PublishVersion(config),
+		Publisher:   publisher,
+		Name:        group.Name,
+		Homepage:    config.Packaging.Homepage,
+		License:     license,
+		Description: desc,
+	}
+	for _, a := range group.Artifacts {
+		arch, found := wingetArchs[a.GOARCH]
+		if a.GOOS != "windows" || !found {
+			continue
+		}
+		url, err := group.URL(config, a)
+		if err != nil {
+			return m, false, err
+		}
+		m.Installers = append(m.Installers, wingetInstaller{Arch: arch, URL: url, SHA256: strings.ToUpper(a.SHA256)})
+		if m.Binaries == nil {
+			if m.Binaries, err = group.BinaryNames(config, a.Distribution()); err != nil {
+				return m, false, err
+			}
+		}
+	}
+	return m, len(m.Installers) > 0, nil
+}
+
+// Write the version, installer and locale manifests using the layout of the
+// winget-pkgs repository: manifests/p/Publisher/Package/version
+func WriteWingetManifest(dir string, m WingetManifest) (loc string, err error) {
+	parts := strings.Split(m.ID, ".")
+	loc = filepath.Join(dir, "manifests", strings.ToLower(m.ID[:1]), filepath.FromSlash(path.Join(parts...)), m.Version)
+	if err = os.MkdirAll(loc, 0755); err != nil {
+		return
+	}
+	files := map[string]string{
+		"version":   m.ID + ".yaml",
+		"installer": m.ID + ".installer.yaml",
+		"locale":    m.ID + ".locale.en-US.yaml",
+	}
+	for name, file := range files {
+		if err = writeTemplateFile(filepath.Join(loc, file), wingetTemplates.Lookup(name), m); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeTemplateFile(loc string, tmpl *template.Template, data interface{}) (err error) {
+	outf, err := os.Create(loc)
+	if err != nil {
+		return
+	}
+	defer outf.Close()
+	return tmpl.Execute(outf, data)
+}
@@ -0,0 +1,426 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Resource types
+const (
+	rtIcon      = 3
+	rtGroupIcon = 14
+	rtVersion   = 16
+	rtManifest  = 24
+)
+
+// Resources use en-US with the unicode code page
+const (
+	resourceLang     = 0x0409
+	resourceCodePage = 1200
+)
+
+// COFF machine and ADDR32NB relocation type of each supported architecture
+var resourceMachines = map[string]struct{ machine, reloc uint16 }{
+	"386":   {0x14c, 0x7},
+	"amd64": {0x8664, 0x3},
+	"arm64": {0xaa64, 0x2},
+}
+
+const defaultResourceManifest = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0">
+  <compatibility xmlns="urn:schemas-microsoft-com:compatibility.v1">
+    <application>
+      <supportedOS Id="{8e0f7a12-bfb3-4fe8-b9a5-48fd50a15a9a}"/>
+      <supportedOS Id="{1f676c76-80e1-4239-95bb-83d0f6d0da78}"/>
+      <supportedOS Id="{4a2f28e3-53b9-4441-ba9c-d69d4a4a6e38}"/>
+      <supportedOS Id="{35138b9a-5d96-4fbd-8e2d-a2440225f93a}"/>
+    </application>
+  </compatibility>
+  <application xmlns="urn:schemas-microsoft-com:asm.v3">
+    <windowsSettings>
+      <longPathAware xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">true</longPathAware>
+    </windowsSettings>
+  </application>
+  <trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+    <security>
+      <requestedPrivileges>
+        <requestedExecutionLevel level="asInvoker" uiAccess="false"/>
+      </requestedPrivileges>
+    </security>
+  </trustInfo>
+</assembly>
+`
+
+// Settings for the resources embedded into windows binaries
+type ResourceConfig struct {
+	Generate bool
+	// Path to an .ico or .png file
+	Icon string
+	// Path to an application manifest. A default manifest is used when empty.
+	Manifest  string
+	Company   string
+	Copyright string
+}
+
+func (c ResourceConfig) Enabled() bool {
+	return c.Generate || c.Icon != "" || c.Manifest != ""
+}
+
+// Check if resources are embedded into the binaries of a distribution
+func (c ResourceConfig) Has(dist Distribution) bool {
+	_, ok := resourceMachines[dist.GOARCH]
+	return c.Enabled() && dist.GOOS == "windows" && ok
+}
+
+func (c ResourceConfig) Validate() (err error) {
+	if c.Icon != "" {
+		data, err := os.ReadFile(c.Icon)
+		if err != nil {
+			return err
+		}
+		if _, _, err = iconResources(data); err != nil {
+			return fmt.Errorf("invalid icon %s: %w", c.Icon, err)
+		}
+	}
+	if c.Manifest != "" {
+		_, err = os.Stat(c.Manifest)
+	}
+	return
+}
+
+type resource struct {
+	Type uint16
+	ID   uint16
+	Data []byte
+}
+
+// Split an icon into an icon resource for each image and the group icon
+// resource which lists them. A PNG is used as a single image icon.
+func iconResources(data []byte) (icons []resource, group []byte, err error) {
+	le := binary.LittleEndian
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		// Sizes of 256 and above are stored as 0
+		entry := []byte{byte(cfg.Width), byte(cfg.Height), 0, 0, 1, 0, 32, 0}
+		if cfg.Width >= 256 {
+			entry[0] = 0
+		}
+		if cfg.Height >= 256 {
+			entry[1] = 0
+		}
+		group = append([]byte{0, 0, 1, 0, 1, 0}, entry...)
+		group = le.AppendUint32(group, uint32(len(data)))
+		group = le.AppendUint16(group, 1)
+		return []resource{{Type: rtIcon, ID: 1, Data: data}}, group, nil
+	}
+	if len(data) < 6 || le.Uint16(data) != 0 || le.Uint16(data[2:]) != 1 {
+		return nil, nil, fmt.Errorf("not an .ico or .png file")
+	}
+	count := int(le.Uint16(data[4:]))
+	if count == 0 || len(data) < 6+16*count {
+		return nil, nil, fmt.Errorf("truncated icon directory")
+	}
+	group = append([]byte{}, data[:6]...)
+	for i := 0; i < count; i++ {
+		entry := data[6+16*i : 6+16*(i+1)]
+		size, offset := le.Uint32(entry[8:]), le.Uint32(entry[12:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("icon image %d is out of bounds", i)
+		}
+		icons = append(icons, resource{Type: rtIcon, ID: uint16(i + 1), Data: data[offset : offset+size]})
+		// The group entry replaces the image offset with the resource ID
+		group = append(group, entry[:12]...)
+		group = le.AppendUint16(group, uint16(i+1))
+	}
+	return
+}
+
+// Parse up to four numbers from a version like v1.2.3-4-gabcdef0
+func resourceVersion(version string) (res [4]uint16) {
+	version = strings.TrimPrefix(version, "v")
+	end := strings.IndexFunc(version, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end >= 0 {
+		version = version[:end]
+	}
+	for i, part := range strings.SplitN(version, ".", 4) {
+		num, _ := strconv.ParseUint(part, 10, 16)
+		res[i] = uint16(num)
+	}
+	return
+}
+
+func utf16z(val string) (res []byte) {
+	for _, c := range utf16.Encode([]rune(val)) {
+		res = binary.LittleEndian.AppendUint16(res, c)
+	}
+	return append(res, 0, 0)
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Encode a node of the VS_VERSIONINFO tree. Each node has its length, the
+// length of its value, its type, a key and then its value and children
+// aligned to 32 bits.
+func versionNode(key string, text bool, value []byte, valueLen int, children ...[]byte) []byte {
+	b := pad4(append(make([]byte, 6), utf16z(key)...))
+	b = append(b, value...)
+	for _, child := range children {
+		b = append(pad4(b), child...)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)))
+	binary.LittleEndian.PutUint16(b[2:], uint16(valueLen))
+	if text {
+		binary.LittleEndian.PutUint16(b[4:], 1)
+	}
+	return b
+}
+
+// Encode the VS_VERSIONINFO resource with the fixed file info and strings
+func versionInfo(version string, strs map[string]string) []byte {
+	le := binary.LittleEndian
+	v := resourceVersion(version)
+	ms, ls := uint32(v[0])<<16|uint32(v[1]), uint32(v[2])<<16|uint32(v[3])
+	fixed := []uint32{
+		0xfeef04bd, 0x10000, // signature and struct version
+		ms, ls, ms, ls, // file and product version
+		0x3f, 0, // flags mask and flags
+		0x40004, 1, 0, // VOS_NT_WINDOWS32, VFT_APP and no subtype
+		0, 0, // date
+	}
+	var fixedData []byte
+	for _, val := range fixed {
+		fixedData = le.AppendUint32(fixedData, val)
+	}
+	keys := make([]string, 0, len(strs))
+	for key, val := range strs {
+		if val != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var entries [][]byte
+	for _, key := range keys {
+		val := utf16z(strs[key])
+		entries = append(entries, versionNode(key, true, val, len(val)/2))
+	}
+	table := versionNode(fmt.Sprintf("%04X%04X", resourceLang, resourceCodePage), true, nil, 0, entries...)
+	translation := le.AppendUint16(le.AppendUint16(nil, resourceLang), resourceCodePage)
+	return versionNode("VS_VERSION_INFO", false, fixedData, len(fixedData),
+		versionNode("StringFileInfo", true, nil, 0, table),
+		versionNode("VarFileInfo", true, nil, 0, versionNode("Translation", false, translation, len(translation))),
+	)
+}
+
+// Encode the resource directory tree of type, ID and language followed by the
+// data entries and the data. Returns the offsets of the data entries which
+// need relocations.
+func resourceSection(resources []resource) (section []byte, relocs []int) {
+	le := binary.LittleEndian
+	sort.SliceStable(resources, func(i, j int) bool {
+		if resources[i].Type != resources[j].Type {
+			return resources[i].Type < resources[j].Type
+		}
+		return resources[i].ID < resources[j].ID
+	})
+	var types []uint16
+	byType := map[uint16][]int{}
+	for i, r := range resources {
+		if len(byType[r.Type]) == 0 {
+			types = append(types, r.Type)
+		}
+		byType[r.Type] = append(byType[r.Type], i)
+	}
+	off := 16 + 8*len(types)
+	typeOffsets := map[uint16]int{}
+	for _, t := range types {
+		typeOffsets[t] = off
+		off += 16 + 8*len(byType[t])
+	}
+	langOffsets, entryOffsets, dataOffsets := make([]int, len(resources)), make([]int, len(resources)), make([]int, len(resources))
+	for i := range resources {
+		langOffsets[i] = off
+		off += 16 + 8
+	}
+	for i := range resources {
+		entryOffsets[i] = off
+		off += 16
+	}
+	for i, r := range resources {
+		off = (off + 7) &^ 7
+		dataOffsets[i] = off
+		off += len(r.Data)
+	}
+	section = make([]byte, (off+7)&^7)
+	// Only the number of ID entries is set in each directory header
+	dir := func(at, count int) {
+		le.PutUint16(section[at+14:], uint16(count))
+	}
+	entry := func(at int, id uint16, target int, subdir bool) {
+		le.PutUint32(section[at:], uint32(id))
+		if subdir {
+			target |= 1 << 31
+		}
+		le.PutUint32(section[at+4:], uint32(target))
+	}
+	dir(0, len(types))
+	for i, t := range types {
+		entry(16+8*i, t, typeOffsets[t], true)
+		dir(typeOffsets[t], len(byType[t]))
+		for j, r := range byType[t] {
+			entry(typeOffsets[t]+16+8*j, resources[r].ID, langOffsets[r], true)
+		}
+	}
+	for i, r := range resources {
+		dir(langOffsets[i], 1)
+		entry(langOffsets[i]+16, resourceLang, entryOffsets[i], false)
+		// The offset becomes an RVA through the relocation
+		le.PutUint32(section[entryOffsets[i]:], uint32(dataOffsets[i]))
+		le.PutUint32(section[entryOffsets[i]+4:], uint32(len(r.Data)))
+		copy(section[dataOffsets[i]:], r.Data)
+		relocs = append(relocs, entryOffsets[i])
+	}
+	return
+}
+
+// Encode a COFF object with a single .rsrc section which the Go linker picks
+// up from .syso files
+func resourceObject(goarch string, resources []resource) (obj []byte, err error) {
+	arch, ok := resourceMachines[goarch]
+	if !ok {
+		return nil, fmt.Errorf("windows resources are not supported on %s", goarch)
+	}
+	le := binary.LittleEndian
+	section, relocs := resourceSection(resources)
+	const headersSize = 20 + 40
+	relocsOffset := headersSize + len(section)
+	symbolsOffset := relocsOffset + 10*len(relocs)
+	var characteristics uint16
+	if goarch == "386" {
+		// IMAGE_FILE_32BIT_MACHINE
+		characteristics = 0x100
+	}
+	obj = le.AppendUint16(obj, arch.machine)
+	obj = le.AppendUint16(obj, 1)
+	obj = le.AppendUint32(obj, 0)
+	obj = le.AppendUint32(obj, uint32(symbolsOffset))
+	obj = le.AppendUint32(obj, 1)
+	obj = le.AppendUint16(obj, 0)
+	obj = le.AppendUint16(obj, characteristics)
+
+	obj = append(obj, ".rsrc\x00\x00\x00"...)
+	obj = le.AppendUint32(obj, 0)
+	obj = le.AppendUint32(obj, 0)
+	obj = le.AppendUint32(obj, uint32(len(section)))
+	obj = le.AppendUint32(obj, headersSize)
+	obj = le.AppendUint32(obj, uint32(relocsOffset))
+	obj = le.AppendUint32(obj, 0)
+	obj = le.AppendUint16(obj, uint16(len(relocs)))
+	obj = le.AppendUint16(obj, 0)
+	// IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ
+	obj = le.AppendUint32(obj, 0x40000040)
+
+	obj = append(obj, section...)
+	for _, offset := range relocs {
+		obj = le.AppendUint32(obj, uint32(offset))
+		obj = le.AppendUint32(obj, 0)
+		obj = le.AppendUint16(obj, arch.reloc)
+	}
+	// The section symbol the relocations refer to followed by an empty string
+	// table
+	obj = append(obj, ".rsrc\x00\x00\x00"...)
+	obj = le.AppendUint32(obj, 0)
+	obj = le.AppendUint16(obj, 1)
+	obj = le.AppendUint16(obj, 0)
+	obj = append(obj, 3, 0)
+	obj = le.AppendUint32(obj, 4)
+	return
+}
+
+// Create the resources for a binary
+func BinaryResources(config BuildConfig, dist Distribution, bin Binary) (resources []resource, err error) {
+	if config.Resources.Icon != "" {
+		data, err := os.ReadFile(config.Resources.Icon)
+		if err != nil {
+			return nil, err
+		}
+		icons, group, err := iconResources(data)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, icons...)
+		resources = append(resources, resource{Type: rtGroupIcon, ID: 1, Data: group})
+	}
+	manifest := []byte(defaultResourceManifest)
+	if config.Resources.Manifest != "" {
+		if manifest, err = os.ReadFile(config.Resources.Manifest); err != nil {
+			return
+		}
+	}
+	resources = append(resources, resource{Type: rtManifest, ID: 1, Data: manifest})
+	filename, err := RenderName(config, dist, bin)
+	if err != nil {
+		return
+	}
+	desc, _, _ := StringCut(strings.TrimSpace(config.Packaging.Description), "\n")
+	if desc == "" {
+		desc = bin.Name
+	}
+	version := PublishVersion(config)
+	resources = append(resources, resource{Type: rtVersion, ID: 1, Data: versionInfo(version, map[string]string{
+		"CompanyName":      config.Resources.Company,
+		"FileDescription":  desc,
+		"FileVersion":      version,
+		"InternalName":     bin.Name,
+		"LegalCopyright":   config.Resources.Copyright,
+		"OriginalFilename": filename,
+		"ProductName":      config.Name,
+		"ProductVersion":   version,
+	})})
+	return
+}
+
+// The name of the generated .syso file. The suffix limits it to the target.
+func SysoName(dist Distribution) string {
+	return fmt.Sprintf("gbuild_%s_%s.syso", dist.GOOS, dist.GOARCH)
+}
+
+// Write the resources of a binary as a .syso file into the directory of its
+// main package. The caller removes it after the build.
+func WriteSyso(config BuildConfig, dist Distribution, bin Binary) (loc string, err error) {
+	args := []string{"list", "-f", "{{.Dir}}"}
+	if bin.Package != "" {
+		args = append(args, bin.Package)
+	}
+	cmd := GoCommand(config, args...)
+	cmd.Env = append(cmd.Env, "GOOS="+dist.GOOS, "GOARCH="+dist.GOARCH)
+	dir, err := commandOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the directory of %s: %w", bin.Name, err)
+	}
+	resources, err := BinaryResources(config, dist, bin)
+	if err != nil {
+		return
+	}
+	obj, err := resourceObject(dist.GOARCH, resources)
+	if err != nil {
+		return
+	}
+	loc = filepath.Join(strings.TrimSpace(dir), SysoName(dist))
+	return loc, os.WriteFile(loc, obj, 0644)
+}
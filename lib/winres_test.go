@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestResourceVersion(t *testing.T) {
+	cases := map[string][4]uint16{
+		"v1.2.3":           {1, 2, 3, 0},
+		"1.2.3.4":          {1, 2, 3, 4},
+		"v1.2.3-4-gabcdef": {1, 2, 3, 0},
+		"v2.0.0+dirty":     {2, 0, 0, 0},
+		"v1.2.3.4.5":       {1, 2, 3, 0},
+		"v1.70000":         {1, 65535, 0, 0},
+		"v10":              {10, 0, 0, 0},
+		"dev":              {0, 0, 0, 0},
+		"":                 {0, 0, 0, 0},
+	}
+	for version, want := range cases {
+		if got := resourceVersion(version); got != want {
+			t.Errorf("resourceVersion(%q) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+// An .ico file with an image of each size
+func testIcon(sizes ...int) []byte {
+	le := binary.LittleEndian
+	ico := le.AppendUint16(le.AppendUint16(le.AppendUint16(nil, 0), 1), uint16(len(sizes)))
+	offset := 6 + 16*len(sizes)
+	var images []byte
+	for _, size := range sizes {
+		img := bytes.Repeat([]byte{byte(size)}, size)
+		ico = append(ico, byte(size), byte(size), 0, 0)
+		ico = le.AppendUint16(le.AppendUint16(ico, 1), 32)
+		ico = le.AppendUint32(le.AppendUint32(ico, uint32(len(img))), uint32(offset+len(images)))
+		images = append(images, img...)
+	}
+	return append(ico, images...)
+}
+
+func TestIconResources(t *testing.T) {
+	icons, group, err := iconResources(testIcon(16, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(icons) != 2 || icons[0].ID != 1 || icons[1].ID != 2 {
+		t.Fatalf("unexpected icons %+v", icons)
+	}
+	for i, size := range []int{16, 32} {
+		if !bytes.Equal(icons[i].Data, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Errorf("icon %d has the wrong data", i)
+		}
+		entry := group[6+14*i : 6+14*(i+1)]
+		if entry[0] != byte(size) || binary.LittleEndian.Uint32(entry[8:]) != uint32(size) || binary.LittleEndian.Uint16(entry[12:]) != uint16(i+1) {
+			t.Errorf("unexpected group entry %d: %v", i, entry)
+		}
+	}
+	if len(group) != 6+14*2 {
+		t.Errorf("unexpected group size %d", len(group))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 256, 48))); err != nil {
+		t.Fatal(err)
+	}
+	icons, group, err = iconResources(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(icons) != 1 || !bytes.Equal(icons[0].Data, buf.Bytes()) {
+		t.Errorf("expected the PNG as a single icon")
+	}
+	if group[6] != 0 || group[7] != 48 || binary.LittleEndian.Uint32(group[14:]) != uint32(buf.Len()) {
+		t.Errorf("unexpected PNG group entry %v", group[6:])
+	}
+
+	truncated := testIcon(16)
+	for _, data := range [][]byte{[]byte("GIF89a"), testIcon(), truncated[:len(truncated)-1]} {
+		if _, _, err = iconResources(data); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+// Find the data of a resource by walking the type, ID and language
+// directories of a .rsrc section. Data entries hold section offsets until
+// they're relocated.
+func findResource(t *testing.T, section []byte, typ, id uint16) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+	lookup := func(dir int, want uint32) uint32 {
+		count := int(le.Uint16(section[dir+12:])) + int(le.Uint16(section[dir+14:]))
+		for i := 0; i < count; i++ {
+			entry := section[dir+16+8*i:]
+			if le.Uint32(entry) == want {
+				return le.Uint32(entry[4:])
+			}
+		}
+		t.Fatalf("resource %d/%d not found", typ, id)
+		return 0
+	}
+	idDir := lookup(0, uint32(typ)) &^ (1 << 31)
+	langDir := lookup(int(idDir), uint32(id)) &^ (1 << 31)
+	dataEntry := lookup(int(langDir), resourceLang)
+	offset, size := le.Uint32(section[dataEntry:]), le.Uint32(section[dataEntry+4:])
+	return section[offset : offset+size]
+}
+
+func TestResourceObject(t *testing.T) {
+	icons, group, err := iconResources(testIcon(16, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := versionInfo("v1.2.3-4-gabcdef", map[string]string{"ProductName": "app", "CompanyName": ""})
+	manifest := []byte(defaultResourceManifest)
+	resources := append(icons,
+		resource{Type: rtGroupIcon, ID: 1, Data: group},
+		resource{Type: rtVersion, ID: 1, Data: version},
+		resource{Type: rtManifest, ID: 1, Data: manifest},
+	)
+	for goarch, machine := range map[string]uint16{"386": pe.IMAGE_FILE_MACHINE_I386, "amd64": pe.IMAGE_FILE_MACHINE_AMD64, "arm64": pe.IMAGE_FILE_MACHINE_ARM64} {
+		obj, err := resourceObject(goarch, resources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := pe.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			t.Fatalf("%s: %s", goarch, err)
+		}
+		if f.Machine != machine || len(f.Sections) != 1 || f.Sections[0].Name != ".rsrc" {
+			t.Fatalf("%s: unexpected object with machine %x and %d sections", goarch, f.Machine, len(f.Sections))
+		}
+		rsrc := f.Sections[0]
+		if len(rsrc.Relocs) != len(resources) {
+			t.Errorf("%s: expected %d relocations, got %d", goarch, len(resources), len(rsrc.Relocs))
+		}
+		if len(f.Symbols) != 1 || f.Symbols[0].Name != ".rsrc" || f.Symbols[0].SectionNumber != 1 {
+			t.Errorf("%s: unexpected symbols %+v", goarch, f.Symbols)
+		}
+		section, err := rsrc.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := findResource(t, section, rtManifest, 1); !bytes.Equal(got, manifest) {
+			t.Errorf("%s: manifest doesn't match", goarch)
+		}
+		if got := findResource(t, section, rtGroupIcon, 1); !bytes.Equal(got, group) {
+			t.Errorf("%s: group icon doesn't match", goarch)
+		}
+		if got := findResource(t, section, rtIcon, 2); !bytes.Equal(got, icons[1].Data) {
+			t.Errorf("%s: icon 2 doesn't match", goarch)
+		}
+		info := findResource(t, section, rtVersion, 1)
+		if !bytes.Equal(info, version) {
+			t.Errorf("%s: version info doesn't match", goarch)
+		}
+	}
+	if _, err = resourceObject("arm", resources); err == nil {
+		t.Error("expected an error for windows/arm")
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	le := binary.LittleEndian
+	info := versionInfo("v1.2.3", map[string]string{"ProductName": "app", "CompanyName": ""})
+	if int(le.Uint16(info)) != len(info) {
+		t.Errorf("length %d doesn't match the size %d", le.Uint16(info), len(info))
+	}
+	key := utf16z("VS_VERSION_INFO")
+	if !bytes.Equal(info[6:6+len(key)], key) {
+		t.Fatal("missing VS_VERSION_INFO key")
+	}
+	fixed := info[(6+len(key)+3)&^3:]
+	if le.Uint32(fixed) != 0xfeef04bd {
+		t.Fatalf("missing fixed file info signature")
+	}
+	if ms, ls := le.Uint32(fixed[8:]), le.Uint32(fixed[12:]); ms != 1<<16|2 || ls != 3<<16 {
+		t.Errorf("unexpected file version %x.%x", ms, ls)
+	}
+	utf16Bytes := func(s string) []byte {
+		b := utf16z(s)
+		return b[:len(b)-2]
+	}
+	if !bytes.Contains(info, utf16Bytes("ProductName")) || !bytes.Contains(info, utf16Bytes("app")) {
+		t.Error("missing ProductName string")
+	}
+	if bytes.Contains(info, utf16Bytes("CompanyName")) {
+		t.Error("empty strings should be left out")
+	}
+}
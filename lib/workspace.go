@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+var ErrNoWorkspace = errors.New("no go.work file found")
+
+type Workspace struct {
+	// Location of the go.work file
+	Path      string
+	GoVersion string
+	Modules   []GoModule
+}
+
+// Find the go.work file. GOWORK may be "off", a path to a go.work file or
+// empty to search up from the current directory.
+func FindWorkFile(gowork string) (loc string, err error) {
+	if gowork == "" {
+		gowork = os.Getenv("GOWORK")
+	}
+	switch gowork {
+	case "off":
+		return "", ErrNoWorkspace
+	case "", "auto":
+	default:
+		return filepath.Abs(gowork)
+	}
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		return
+	}
+	for {
+		loc = filepath.Join(dir, "go.work")
+		if info, err := os.Stat(loc); err == nil && !info.IsDir() {
+			return loc, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNoWorkspace
+		}
+		dir = parent
+	}
+}
+
+// Parse a go.work file and the go.mod file of each module it uses
+func ParseWork(loc string) (ws Workspace, err error) {
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		return
+	}
+	f, err := modfile.ParseWork(loc, data, nil)
+	if err != nil {
+		return
+	}
+	ws.Path = loc
+	if f.Go != nil {
+		ws.GoVersion = f.Go.Version
+	}
+	for _, use := range f.Use {
+		dir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(loc), dir)
+		}
+		mod, err := ParseMod(filepath.Join(dir, "go.mod"))
+		if err != nil {
+			return ws, err
+		}
+		ws.Modules = append(ws.Modules, mod)
+	}
+	return
+}
+
+// Select workspace modules by module path, name or directory. "all" selects
+// every module.
+func (w Workspace) Select(selector string) (res []GoModule, err error) {
+	if selector == "all" {
+		return w.Modules, nil
+	}
+	dir, _ := filepath.Abs(selector)
+	for _, mod := range w.Modules {
+		if mod.Path == selector || mod.Name == selector || mod.Dir == dir {
+			res = append(res, mod)
+		}
+	}
+	if len(res) == 0 {
+		err = fmt.Errorf("module %s is not in the workspace %s", selector, w.Path)
+	}
+	return
+}